@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const (
+	anchorBegin = "#archive-begin-" // начало строки-якоря начала данных канала
+	anchorEnd   = "#archive-end"    // строка-якорь конца данных канала
+)
+
+var anchorKeys = []string{"days", "group", "filter", "template"} // допустимые параметры строки-якоря
+
+// anchor разобранная строка-якорь начала данных канала:
+//
+//	#archive-begin-<канал> [days=3] [group="Фильмы (архив)"] [filter="(?i)фильм"] [template="..."]
+//
+// Параметры заменяют настройки канала для этого блока
+type anchor struct {
+	channel string             // название канала в секции channels. Может содержать "-"
+	days    int                // глубина архива в днях. -1 - из настроек канала
+	group   string             // группа записей архива. Пустая строка - из настроек канала
+	filter  *regexp.Regexp     // в блок попадают только передачи, название которых подходит под выражение. nil - все
+	extinf  *template.Template // шаблон строки #EXTINF. nil - из настроек канала
+}
+
+// isAnchorBegin сообщает, что строка плейлиста - строка-якорь начала (возможно, с ошибкой)
+func isAnchorBegin(str string) bool {
+	return strings.HasPrefix(str, "#archive-begin")
+}
+
+// isAnchorEnd сообщает, что строка плейлиста - строка-якорь конца
+func isAnchorEnd(str string) bool {
+	return strings.HasPrefix(str, anchorEnd)
+}
+
+// parseAnchor разбирает строку-якорь начала. Если название канала есть, но в параметрах ошибка, возвращает
+// и ошибку, и якорь без неверных параметров: блок канала остается блоком канала. nil - строку не разобрать
+func parseAnchor(str string) (*anchor, error) {
+	if !strings.HasPrefix(str, anchorBegin) {
+		return nil, fmt.Errorf("после #archive-begin должно идти \"-\" и название канала. Правильный пример: %srossija", anchorBegin)
+	}
+	rest := strings.TrimRightFunc(str[len(anchorBegin):], unicode.IsSpace)
+
+	a := &anchor{days: -1}
+	end := strings.IndexFunc(rest, unicode.IsSpace)
+	if end < 0 {
+		end = len(rest)
+	}
+	a.channel, rest = rest[:end], rest[end:]
+	if a.channel == "" {
+		return nil, fmt.Errorf("не указано название канала. Правильный пример: %srossija", anchorBegin)
+	}
+
+	var first error // первая ошибка в параметрах
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			return a, first
+		}
+		key, value, next, err := nextAnchorOption(rest)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			return a, first // дальше строку не разобрать
+		}
+		rest = next
+		if err = a.set(key, value); err != nil && first == nil {
+			first = fmt.Errorf("параметр %s: %v", key, err)
+		}
+	}
+}
+
+// nextAnchorOption выделяет из начала строки параметр вида ключ=значение или ключ="значение с пробелами"
+func nextAnchorOption(str string) (key, value, rest string, err error) {
+	eq := strings.IndexByte(str, '=')
+	if sp := strings.IndexFunc(str, unicode.IsSpace); eq < 0 || (sp >= 0 && sp < eq) {
+		return "", "", "", fmt.Errorf("ожидается параметр вида ключ=значение, а не %q", strings.Fields(str)[0])
+	}
+	key, rest = str[:eq], str[eq+1:]
+	if key == "" {
+		return "", "", "", fmt.Errorf("не указано имя параметра перед \"=\"")
+	}
+
+	if !strings.HasPrefix(rest, `"`) {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		return key, rest[:end], rest[end:], nil
+	}
+
+	// значение в кавычках. Экранируются только кавычка и обратная косая черта: \" и \\.
+	// Остальные обратные косые черты остаются как есть, чтобы в filter можно было писать \d+
+	var buf strings.Builder
+	for i := 1; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case c == '\\' && i+1 < len(rest) && (rest[i+1] == '"' || rest[i+1] == '\\'):
+			i++
+			buf.WriteByte(rest[i])
+		case c == '"':
+			return key, buf.String(), rest[i+1:], nil
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", "", "", fmt.Errorf("параметр %s: нет закрывающей кавычки", key)
+}
+
+// set применяет параметр строки-якоря. Неверное значение не применяется
+func (a *anchor) set(key, value string) error {
+	switch key {
+	case "days": // глубина архива в днях
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 || days > 365 {
+			return fmt.Errorf("значение %q должно быть целым числом от 0 до 365", value)
+		}
+		a.days = days
+	case "group": // группа записей архива
+		a.group = value
+	case "filter": // регулярное выражение для названий передач
+		filter, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		a.filter = filter
+	case "template": // шаблон строки #EXTINF
+		extinf, err := parseTemplate("template", value)
+		if err != nil {
+			return err
+		}
+		a.extinf = extinf
+	default:
+		return fmt.Errorf("неизвестный параметр. Допустимые параметры: %s", strings.Join(anchorKeys, ", "))
+	}
+	return nil
+}
+
+// apply отбирает передачи блока и подставляет группу из параметров строки-якоря. list не изменяется
+func (a *anchor) apply(list []progr) []progr {
+	var res []progr
+	for _, vol := range list {
+		if a.filter != nil && !a.filter.MatchString(vol.nameProgr) {
+			continue
+		}
+		if a.group != "" {
+			vol.group = a.group
+		}
+		res = append(res, vol)
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseAnchor(t *testing.T) {
+	tests := []struct {
+		line    string
+		channel string // пустое - строку не разобрать
+		days    int
+		group   string
+		filter  string
+		extinf  bool
+		wantErr bool
+	}{
+		{line: "#archive-begin-rossija", channel: "rossija", days: -1},
+		{line: "#archive-begin-rossija  \t", channel: "rossija", days: -1},
+		{line: "#archive-begin-ren-tv", channel: "ren-tv", days: -1},
+		{line: "#archive-begin-ren-tv days=3", channel: "ren-tv", days: 3},
+		{line: "#archive-begin-ntv days=0 group=Архив", channel: "ntv", days: 0, group: "Архив"},
+		{line: `#archive-begin-ntv group="Фильмы (архив)" filter="(?i)фильм"`, channel: "ntv", days: -1, group: "Фильмы (архив)", filter: "(?i)фильм"},
+		{line: `#archive-begin-ntv group="Кино \"Новое\" \\ старое"`, channel: "ntv", days: -1, group: `Кино "Новое" \ старое`},
+		{line: `#archive-begin-ntv template="{{.Name}},{{.TimeBegin}}"`, channel: "ntv", days: -1, extinf: true},
+		{line: `#archive-begin-ntv filter="\d+"`, channel: "ntv", days: -1, filter: `\d+`},
+		{line: `#archive-begin-ntv filter="^\w+\s\\d$"`, channel: "ntv", days: -1, filter: `^\w+\s\d$`},
+		{line: `#archive-begin-ntv group="Кино\tархив\\"`, channel: "ntv", days: -1, group: `Кино\tархив\`},
+
+		{line: "#archive-beginrossija", wantErr: true},
+		{line: "#archive-begin-", wantErr: true},
+		{line: "#archive-begin- days=3", wantErr: true},
+
+		// ошибка в параметрах: неверные параметры не применяются, остальные применяются
+		{line: "#archive-begin-ntv days", channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv =3", channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv days=abc", channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv days=-1", channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv days=366", channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv color=red", channel: "ntv", days: -1, wantErr: true},
+		{line: `#archive-begin-ntv group="Без кавычки`, channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv filter=(", channel: "ntv", days: -1, wantErr: true},
+		{line: `#archive-begin-ntv template="{{.Name"`, channel: "ntv", days: -1, wantErr: true},
+		{line: "#archive-begin-ntv days=abc group=Архив days=5", channel: "ntv", days: 5, group: "Архив", wantErr: true},
+		{line: "#archive-begin-ntv group=Архив filter=( days", channel: "ntv", days: -1, group: "Архив", wantErr: true},
+	}
+	for _, tt := range tests {
+		a, err := parseAnchor(tt.line)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: ожидается ошибка, разобрано %+v", tt.line, a)
+			continue
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		if tt.channel == "" {
+			if a != nil {
+				t.Errorf("%s: разобрано %+v, ожидается nil", tt.line, a)
+			}
+			continue
+		}
+		if a == nil {
+			t.Errorf("%s: не разобрано название канала", tt.line)
+			continue
+		}
+		filter := ""
+		if a.filter != nil {
+			filter = a.filter.String()
+		}
+		if a.channel != tt.channel || a.days != tt.days || a.group != tt.group || filter != tt.filter || (a.extinf != nil) != tt.extinf {
+			t.Errorf("%s: разобрано %+v", tt.line, a)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+// режимы вывода архива в плейлист
+const (
+	archiveModePrograms = "programs" // отдельная запись на каждую передачу между строками-якорями
+	archiveModeCatchup  = "catchup"  // атрибуты catchup у записи канала перед строкой-якорем
+	archiveModeBoth     = "both"     // и то, и другое
+)
+
+// шаблон ссылки на запись передачи для плеера. {catchup-id} плеер берет из XMLTV (атрибут catchup-id передачи)
+const defCatchupSource = "http://hls.peers.tv/playlist/program/{catchup-id}.m3u8"
+
+var defCatchupTmpl = template.Must(parseTemplate("catchupsource", defCatchupSource))
+
+// catchupDays возвращает, за сколько дней назад доступен архив канала. Считается от самого раннего дня программы передач
+func catchupDays(list []progr, now time.Time) int {
+	var first time.Time
+	for _, vol := range list {
+		if first.IsZero() || vol.dataProgr.Before(first) {
+			first = vol.dataProgr
+		}
+	}
+	if first.IsZero() {
+		return 0
+	}
+	days := int(dayStart(now).Sub(first).Hours() / 24)
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// liveEntryFor ищет запись канала для атрибутов catchup: запись непосредственно перед строкой-якорем, если она
+// относится к каналу, иначе - запись канала в любом месте плейлиста. anchor - номер строки-якоря в nodes.
+// Возвращает nil, если запись канала не найдена
+func liveEntryFor(nodes []m3u.Node, anchor int, ch string, set *settings, data map[string][]progr) *m3u.Entry {
+	i := anchor - 1
+	for i >= 0 {
+		if text, ok := nodes[i].(*m3u.Text); !ok || strings.TrimSpace(text.Text) != "" {
+			break
+		}
+		i-- // пустые строки пропустить
+	}
+	if i >= 0 {
+		if entry, ok := nodes[i].(*m3u.Entry); ok {
+			if level, _ := newLiveMatcher(ch, set, data).match(entry); level != matchNone {
+				return entry
+			}
+		}
+	}
+	if i = findLiveEntry(nodes, ch, set, data); i < 0 {
+		return nil
+	}
+	return nodes[i].(*m3u.Entry)
+}
+
+// annotateLiveEntry добавляет в строку #EXTINF записи канала атрибуты catchup
+func annotateLiveEntry(entry *m3u.Entry, source string, days int) {
+	setOwnedAttr(entry, "catchup", "default")
+	setOwnedAttr(entry, "catchup-source", source)
+	setOwnedAttr(entry, "catchup-days", strconv.Itoa(days))
+}
+
+// атрибут записи канала со списком атрибутов, которые добавила программа. По нему они удаляются,
+// когда канал удален из настроек или архив больше не выводится в режиме catchup
+const ownedAttrsKey = "updplaylist-attrs"
+
+// setOwnedAttr задает атрибут записи канала. Атрибут, которого не было в записи, запоминается в ownedAttrsKey.
+// Атрибут, который задал пользователь, изменяется, но программе не принадлежит и не удаляется
+func setOwnedAttr(entry *m3u.Entry, key, value string) {
+	if _, ok := entry.Attrs.Get(key); !ok {
+		owned := ownedAttrs(entry)
+		entry.Attrs.Set(ownedAttrsKey, strings.Join(append(owned, key), ","))
+	}
+	entry.Attrs.Set(key, value)
+}
+
+// ownedAttrs возвращает атрибуты записи, которые добавила программа
+func ownedAttrs(entry *m3u.Entry) []string {
+	value, _ := entry.Attrs.Get(ownedAttrsKey)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// clearOwnedAttrs удаляет из записей плейлиста атрибуты, которые добавила программа при прошлом обновлении.
+// Те, что нужны и сейчас, добавляются заново
+func clearOwnedAttrs(nodes []m3u.Node) {
+	for _, node := range nodes {
+		entry, ok := node.(*m3u.Entry)
+		if !ok {
+			continue
+		}
+		owned := ownedAttrs(entry)
+		if owned == nil {
+			continue
+		}
+		remove := map[string]bool{ownedAttrsKey: true}
+		for _, key := range owned {
+			remove[key] = true
+		}
+		var attrs m3u.Attrs
+		for _, attr := range entry.Attrs {
+			if !remove[attr.Key] {
+				attrs = append(attrs, attr)
+			}
+		}
+		entry.Attrs = attrs
+	}
+}
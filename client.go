@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const retryBaseDelay = time.Second // пауза перед первым повтором запроса. Перед каждым следующим повтором удваивается
+
+// httpFetcher общий http-клиент для запросов к сайтам с программой передач.
+// Ограничивает время запроса, повторяет неудачные запросы и не запрашивает один сайт чаще заданного
+type httpFetcher struct {
+	mu        sync.Mutex
+	client    *http.Client
+	timeout   time.Duration        // время ожидания одного запроса. 0 - без ограничения
+	retries   int                  // количество повторов неудачного запроса
+	interval  time.Duration        // минимальный интервал между запросами к одному сайту. 0 - без ограничения
+	userAgent string               // заголовок User-Agent
+	proxy     *url.URL             // прокси-сервер. nil - из переменных окружения HTTP_PROXY, HTTPS_PROXY
+	next      map[string]time.Time // время, раньше которого нельзя запрашивать сайт. Ключ - имя сайта
+}
+
+var fetcher = newHTTPFetcher()
+
+// newHTTPFetcher создает http-клиент. Настройки задаются configure
+func newHTTPFetcher() *httpFetcher {
+	f := &httpFetcher{next: make(map[string]time.Time)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = f.proxyURL
+	f.client = &http.Client{Transport: transport}
+	return f
+}
+
+// configure применяет настройки http-клиента. Вызывается после каждого перечитывания настроек
+func (f *httpFetcher) configure(set *settings) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timeout = time.Duration(set.timeout) * time.Second
+	f.retries = set.retries
+	f.interval = 0
+	if set.rps > 0 {
+		f.interval = time.Duration(float64(time.Second) / set.rps)
+	}
+	f.userAgent = set.useragent
+	f.proxy = set.proxy
+}
+
+// proxyURL выбирает прокси-сервер для запроса
+func (f *httpFetcher) proxyURL(req *http.Request) (*url.URL, error) {
+	f.mu.Lock()
+	proxy := f.proxy
+	f.mu.Unlock()
+	if proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	return proxy, nil
+}
+
+// get запрашивает страницу и читает ответ целиком. Ошибки сети и ответы 5xx и 429 повторяются с нарастающей паузой.
+// Ответ с любым другим статусом возвращается без ошибки: статус проверяет вызывающий
+func (f *httpFetcher) get(ctx context.Context, rawurl string, header http.Header) (*http.Response, []byte, error) {
+	f.mu.Lock()
+	retries := f.retries
+	f.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		resp, body, err := f.try(ctx, rawurl, header)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err() // обновление прервано. Не повторять
+		}
+		retry := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !retry || attempt >= retries {
+			return resp, body, err
+		}
+
+		delay := backoff(attempt)
+		if err != nil {
+			log.Printf("Ошибка при запросе %s: %v. Повтор через %v\n", rawurl, err, delay)
+		} else {
+			log.Printf("Запрос %s: %s. Повтор через %v\n", rawurl, resp.Status, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// try выполняет одну попытку запроса
+func (f *httpFetcher) try(ctx context.Context, rawurl string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.wait(ctx, req.URL.Host); err != nil {
+		return nil, nil, err
+	}
+
+	f.mu.Lock()
+	timeout, userAgent := f.timeout, f.userAgent
+	f.mu.Unlock()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body) // время чтения ответа тоже ограничено timeout
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// wait ждет, пока можно будет запросить сайт, не превышая заданное количество запросов в секунду
+func (f *httpFetcher) wait(ctx context.Context, host string) error {
+	f.mu.Lock()
+	now := time.Now()
+	at := f.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	f.next[host] = at.Add(f.interval) // занять очередь, даже если горутин несколько
+	f.mu.Unlock()
+
+	if d := time.Until(at); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// backoff возвращает паузу перед повтором запроса: удвоенную по сравнению с предыдущей, со случайным разбросом ±50%
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const cnruURL = "http://www.cn.ru" // адрес сайта с программой передач
+
+// cnruProvider получает программу передач с сайта www.cn.ru
+type cnruProvider struct{}
+
+// listDays парсит основную страницу канала. Получает ссылки на каждый день программы передач.
+func (cnruProvider) listDays(ctx context.Context, channel string) ([]listDay, error) {
+	var list []listDay
+
+	doc, err := fetchDocument(ctx, cnruURL+"/tv/program/"+channel+"/", time.Time{}) // список дней меняется каждый день
+	if err != nil {
+		return nil, err
+	}
+
+	nameChannel := doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content h2.prg-channel span").Text()
+
+	doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content #mtvprg-week.prg-week a").Each(func(i int, s *goquery.Selection) {
+		if articleURL, ok := s.Attr("href"); ok {
+			thisDay := listDay{}
+			thisDay.nameChannel = nameChannel
+			articleURLSplit := strings.Split(articleURL, "/")
+			thisDay.dataProgr, _ = time.Parse("2006-01-02", articleURLSplit[len(articleURLSplit)-2])
+			thisDay.channel = channel
+			thisDay.url = articleURL
+			thisDay.day = s.Find("strong").Text()
+			thisDay.dayOfWeek = s.Find("small").Text()
+			list = append(list, thisDay)
+		}
+	})
+
+	return list, nil
+}
+
+// listProgr запрашивает html-страницу дня. Парсит и собирает данные по программам в массив
+func (cnruProvider) listProgr(ctx context.Context, day listDay) ([]progr, error) {
+	var listProgr []progr
+	sourceURL := cnruURL + day.url
+
+	// передачи дня заканчиваются ночью следующего дня. После этого страница прошедшего дня уже не меняется
+	doc, err := fetchDocument(ctx, sourceURL, day.dataProgr.AddDate(0, 0, 2))
+	if err != nil {
+		return nil, err
+	}
+	doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content #mtvprg-program.prg-list ol li").Each(func(i int, s *goquery.Selection) {
+		s.Find(".tlcbar.is-able").Each(func(i int, s *goquery.Selection) {
+			strProgr := progr{}
+			timeBeginProgr := s.Find("ins").Text()
+			nameProgr := s.Find("dfn a").Text()
+
+			hrefDate, _ := s.Find("ins a").Attr("href")
+			splitStr := strings.Split(hrefDate, "/")
+			strDate := splitStr[len(splitStr)-2]
+			dateTime, _ := time.Parse("2006-01-02T15:04:05-0700", strDate)
+			yearPr, monthPr, dayPr := dateTime.Date()
+			datePr := time.Date(yearPr, monthPr, dayPr, 0, 0, 0, 0, dateTime.Location())
+
+			hrefProgr, _ := s.Find("dfn a").Attr("href")
+			splitStr = strings.Split(hrefProgr, "/")
+			id := splitStr[len(splitStr)-2]
+
+			strProgr.datepr = datePr
+			strProgr.timepr = dateTime
+			strProgr.timeBeginProgr = timeBeginProgr
+			strProgr.nameProgr = nameProgr
+			strProgr.hrefProgr = cnruURL + hrefProgr
+			strProgr.idProgr = id
+			listProgr = append(listProgr, strProgr)
+		})
+	})
+
+	return listProgr, nil
+}
+
+// progrDetails парсит страницу передачи. Описание и постер берутся из метатегов Open Graph,
+// жанр, год, страна и возрастное ограничение - из списка характеристик передачи
+func (cnruProvider) progrDetails(ctx context.Context, p progr) (progrDetails, error) {
+	var details progrDetails
+
+	doc, err := fetchDocument(ctx, p.hrefProgr, time.Time{})
+	if err != nil {
+		return details, err
+	}
+
+	details.description = strings.TrimSpace(doc.Find(".tv-inner-content .prg-description").First().Text())
+	if details.description == "" {
+		details.description = strings.TrimSpace(doc.Find(`meta[property="og:description"]`).AttrOr("content", ""))
+	}
+	details.poster = doc.Find(`meta[property="og:image"]`).AttrOr("content", "")
+	if strings.HasPrefix(details.poster, "/") {
+		details.poster = cnruURL + details.poster
+	}
+
+	// характеристики передачи: <dt>Жанр</dt><dd>Комедия</dd>
+	doc.Find(".tv-inner-content dl dt").Each(func(i int, s *goquery.Selection) {
+		value := strings.TrimSpace(s.NextFiltered("dd").Text())
+		switch label := strings.ToLower(strings.TrimSpace(s.Text())); {
+		case strings.HasPrefix(label, "жанр"):
+			details.genre = value
+		case strings.HasPrefix(label, "год"):
+			details.year = value
+		case strings.HasPrefix(label, "стран"):
+			details.country = value
+		case strings.HasPrefix(label, "возраст"):
+			details.ageRating = value
+		}
+	})
+	if details.ageRating == "" {
+		details.ageRating = strings.TrimSpace(doc.Find(".tv-inner-content .prg-age").First().Text())
+	}
+
+	return details, nil
+}
+
+// fetchDocument запрашивает html-страницу (или берет ее из кэша) и разбирает ее. Запрос прерывается при отмене ctx.
+// final - время, после которого страница больше не меняется. Нулевое, если страница может измениться в любой момент
+func fetchDocument(ctx context.Context, url string, final time.Time) (*goquery.Document, error) {
+	body, err := fetchPage(ctx, url, final)
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
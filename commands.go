@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// коды завершения программы
+const (
+	exitOK      = 0 // все выполнено
+	exitFailure = 1 // не по всем каналам получена программа передач, плейлист не записан или не прошел проверку
+	exitUsage   = 2 // неверная команда или ошибка в настройках
+)
+
+// usage выводит справку по командам
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Использование: %s [флаги] [команда]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Команды:")
+	fmt.Fprintln(out, "  run          работать в режиме службы (по умолчанию)")
+	fmt.Fprintln(out, "  once         один раз обновить плейлист и выйти")
+	fmt.Fprintln(out, "  validate     проверить файл настроек и строки-якоря плейлиста")
+	fmt.Fprintln(out, "  rollback [N] восстановить плейлист из резервной копии N (по умолчанию 1 - самая новая)")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Коды завершения: %d - успешно, %d - ошибка получения данных, записи или проверки, %d - неверная команда или настройки\n\n", exitOK, exitFailure, exitUsage)
+	fmt.Fprintln(out, "Флаги:")
+	flag.PrintDefaults()
+}
+
+// cmdOnce выполняет одно обновление плейлиста
+func cmdOnce() int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := reloadSettings(); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка при загрузке файла с настройками:", err)
+		return exitUsage
+	}
+
+	failed, err := updatePlaylist(ctx, nil)
+	closeStore()
+	if len(failed) > 0 {
+		fmt.Fprintln(os.Stderr, "Не удалось получить программу передач каналов:", strings.Join(failed, ", "))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка при обновлении плейлиста:", err)
+	}
+	if len(failed) > 0 || err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// cmdValidate проверяет файл настроек и строки-якоря плейлиста. Файлы не изменяются
+func cmdValidate() int {
+	var set settings
+	if _, _, err := loadSettings(&set); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка в файле с настройками:", err)
+		return exitUsage
+	}
+
+	lines, err := readLines(set.pathplaylist)
+	if os.IsNotExist(err) {
+		fmt.Printf("Предупреждение: плейлиста %s нет. Он будет создан при первом обновлении\n", set.pathplaylist)
+		fmt.Println("Настройки в порядке")
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка при открытии и считывании плейлиста:", err)
+		return exitFailure
+	}
+
+	problems, warnings := validateAnchors(lines, &set)
+	for _, w := range warnings {
+		fmt.Println("Предупреждение:", w)
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "Ошибка:", p)
+	}
+	if len(problems) > 0 {
+		return exitFailure
+	}
+	fmt.Println("Настройки и плейлист в порядке")
+	return exitOK
+}
+
+// validateAnchors проверяет строки-якоря плейлиста.
+// Ошибки - неверные и непарные строки-якоря. Предупреждения - каналы без строк-якорей и строки-якоря каналов, которых нет в настройках
+func validateAnchors(lines []string, set *settings) (problems, warnings []string) {
+	var channels []string
+	for _, key := range set.channels {
+		channels = append(channels, key.Value())
+	}
+	anchored := make(map[string]bool)
+
+	open := 0 // номер строки незакрытой строки-якоря начала
+	for i, str := range lines {
+		n := i + 1
+		switch {
+		case isAnchorBegin(str):
+			if open > 0 {
+				problems = append(problems, fmt.Sprintf("строка %d: строка-якорь начала со строки %d не закрыта #archive-end", n, open))
+			}
+			open = n
+			a, err := parseAnchor(str)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("строка %d: %s: %v", n, str, err))
+			}
+			if a == nil {
+				continue
+			}
+			ch := a.channel
+			if anchored[ch] {
+				warnings = append(warnings, fmt.Sprintf("строка %d: повторная строка-якорь канала %s", n, ch))
+			}
+			anchored[ch] = true
+			if isOrphan(ch, set) {
+				warnings = append(warnings, fmt.Sprintf("строка %d: канала %s нет в секции channels. Строка-якорь будет %s", n, ch, orphanAction(set.orphans)))
+			}
+		case isAnchorEnd(str):
+			if open == 0 {
+				problems = append(problems, fmt.Sprintf("строка %d: #archive-end без строки-якоря начала", n))
+			}
+			open = 0
+		}
+	}
+	if open > 0 {
+		problems = append(problems, fmt.Sprintf("строка %d: строка-якорь начала не закрыта #archive-end", open))
+	}
+
+	place := "в конец плейлиста"
+	if set.anchorplace == anchorPlaceEntry {
+		place = "после записи канала с прямой трансляцией, а если она не найдется - в конец плейлиста"
+	}
+	for _, ch := range channels {
+		if !anchored[ch] {
+			warnings = append(warnings, fmt.Sprintf("для канала %s нет строки-якоря. Она будет добавлена %s", ch, place))
+		}
+	}
+	return problems, warnings
+}
+
+// cmdRollback восстанавливает плейлист из резервной копии
+func cmdRollback(args []string) int {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "Неверный номер резервной копии %q\n", args[0])
+			return exitUsage
+		}
+	}
+
+	var set settings
+	if _, _, err := loadSettings(&set); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка при загрузке файла с настройками:", err)
+		return exitUsage
+	}
+	if err := rollbackPlaylist(set.pathplaylist, n, set.backups); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка при восстановлении плейлиста:", err)
+		return exitFailure
+	}
+	fmt.Printf("Плейлист %s восстановлен из копии %s\n", set.pathplaylist, backupPath(set.pathplaylist, n))
+	return exitOK
+}
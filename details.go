@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// подробности о передаче со страницы передачи
+type progrDetails struct {
+	description string // описание
+	genre       string // жанр
+	ageRating   string // возрастное ограничение, например 16+
+	year        string // год выпуска
+	country     string // страна
+	poster      string // ссылка на постер
+}
+
+// empty сообщает, что подробностей о передаче нет
+func (d progrDetails) empty() bool {
+	return d == progrDetails{}
+}
+
+// detailsProvider поставщик, который умеет получать подробности о передаче.
+// Подробности запрашиваются пулом горутин вместе с программой передач, если в настройках задано details = true
+type detailsProvider interface {
+	// progrDetails получает подробности о передаче по ссылке на ее страницу
+	progrDetails(ctx context.Context, p progr) (progrDetails, error)
+}
+
+var detailsCache = make(map[string]progrDetails) // подробности о передачах. Ключ - идентификатор передачи
+var detailsMutex = &sync.Mutex{}                 // защищает detailsCache. Используется горутинами пула одновременно
+
+// enrichProgr дополняет передачу подробностями. Берет их из кэша, из хранилища или запрашивает у поставщика.
+// Ошибка не мешает обновлению плейлиста: передача остается без подробностей, запрос повторится при следующем обновлении
+func enrichProgr(ctx context.Context, p provider, vol *progr) {
+	dp, ok := p.(detailsProvider)
+	if !ok || !vol.details.empty() || vol.idProgr == "" || vol.hrefProgr == "" {
+		return
+	}
+
+	detailsMutex.Lock()
+	details, ok := detailsCache[vol.idProgr]
+	detailsMutex.Unlock()
+	if ok {
+		vol.details = details
+		return
+	}
+	if details, ok = storedDetails(*vol); ok { // получены при прошлом запуске программы
+		detailsMutex.Lock()
+		detailsCache[vol.idProgr] = details
+		detailsMutex.Unlock()
+		vol.details = details
+		return
+	}
+
+	details, err := dp.progrDetails(ctx, *vol)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Ошибка при получении подробностей о передаче. Канал = %s, URL=%s: %v\n", vol.channel, vol.hrefProgr, err)
+		}
+		return
+	}
+	detailsMutex.Lock()
+	detailsCache[vol.idProgr] = details
+	detailsMutex.Unlock()
+	vol.details = details
+}
+
+// pruneDetails удаляет из кэша подробности о передачах, которых больше нет в программе передач
+func pruneDetails(data map[string][]progr) {
+	used := make(map[string]bool)
+	for _, vol := range data {
+		for _, p := range vol {
+			used[p.idProgr] = true
+		}
+	}
+
+	detailsMutex.Lock()
+	defer detailsMutex.Unlock()
+	for id := range detailsCache {
+		if !used[id] {
+			delete(detailsCache, id)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic записывает файл через временный файл в том же каталоге, который затем переименовывается.
+// Плеер или прерванная программа никогда не увидят наполовину записанный файл.
+// Если backups больше нуля, прежняя версия файла сохраняется в резервную копию <path>.1, более старые сдвигаются.
+// Если содержимое не изменилось, файл не переписывается и резервные копии не сдвигаются
+func writeFileAtomic(path string, backups int, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, buf.Bytes()) {
+		return nil // иначе резервные копии быстро заполнятся одинаковыми файлами
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // после успешного переименования файла уже нет
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync() // данные должны оказаться на диске до переименования
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// сохранить права доступа прежнего файла
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if err = rotateBackups(path, backups); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// backupPath возвращает имя резервной копии файла с номером n
+func backupPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// rotateBackups сдвигает резервные копии файла (.1 -> .2, ...) и сохраняет текущую версию в копию .1.
+// Текущий файл остается на месте, поэтому плейлист доступен и во время ротации
+func rotateBackups(path string, backups int) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil // сохранять нечего
+	}
+
+	os.Remove(backupPath(path, backups)) // самая старая копия больше не нужна
+	for n := backups - 1; n >= 1; n-- {
+		if err := os.Rename(backupPath(path, n), backupPath(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// жесткая ссылка не требует копирования. Если файловая система ее не поддерживает - скопировать
+	if err := os.Link(path, backupPath(path, 1)); err == nil {
+		return nil
+	}
+	return copyFile(path, backupPath(path, 1))
+}
+
+// copyFile копирует содержимое файла
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir сбрасывает на диск каталог, чтобы переименование файла пережило сбой питания. Ошибки не критичны
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// rollbackPlaylist восстанавливает плейлист из резервной копии с номером n.
+// Заменяемая версия сама сохраняется в копию .1, поэтому откат можно отменить повторным откатом
+func rollbackPlaylist(path string, n, backups int) error {
+	if n > backups {
+		return fmt.Errorf("хранится не более %d резервных копий", backups)
+	}
+	data, err := ioutil.ReadFile(backupPath(path, n))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, backups, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const httpCacheMaxAge = 30 * 24 * time.Hour // записи кэша, которые столько времени не использовались, удаляются
+
+// сведения о странице в кэше. Хранятся рядом со страницей в файле <хэш>.json
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"` // время, когда содержимое страницы последний раз сверялось с сайтом
+}
+
+// fetchPage возвращает содержимое страницы. Если задан каталог кэша, страница сохраняется на диск.
+// Копия в кэше используется без запроса к сайту, если она получена после final (страница больше не меняется)
+// или моложе cachettl. Иначе сайт запрашивается с условиями If-None-Match/If-Modified-Since
+func fetchPage(ctx context.Context, url string, final time.Time) ([]byte, error) {
+	dir := cfstruct.cachedir
+	if dir == "" {
+		body, _, err := httpGet(ctx, url, nil)
+		return body, err
+	}
+
+	path := cachePath(dir, url)
+	meta, body, cached := readCache(path)
+	if cached {
+		now := time.Now()
+		fresh := now.Sub(meta.Fetched) < time.Duration(cfstruct.cachettl)*time.Second
+		if fresh || (!final.IsZero() && meta.Fetched.After(final)) {
+			os.Chtimes(path+".json", now, now) // запись использована. Не удалять ее при чистке кэша
+			return body, nil
+		}
+	}
+
+	var cond *cacheMeta
+	if cached {
+		cond = &meta
+	}
+	newBody, resp, err := httpGet(ctx, url, cond)
+	if err != nil {
+		if cached && ctx.Err() == nil {
+			log.Printf("Ошибка при запросе %s: %v. Используется копия из кэша от %s\n", url, err, meta.Fetched.Format("02.01.2006 15:04"))
+			return body, nil
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		body = newBody
+		meta = cacheMeta{URL: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	} else {
+		newBody = nil // ответ 304 Not Modified: копия в кэше снова свежая, перезаписать только сведения о ней
+	}
+	meta.Fetched = time.Now()
+	if err := writeCache(path, meta, newBody); err != nil {
+		log.Printf("Ошибка при записи страницы %s в кэш: %v\n", url, err)
+	}
+	return body, nil
+}
+
+// httpGet запрашивает страницу общим http-клиентом. Если передан meta, запрос условный, и ответ 304 Not Modified не считается ошибкой
+func httpGet(ctx context.Context, url string, meta *cacheMeta) ([]byte, *http.Response, error) {
+	header := make(http.Header)
+	if meta != nil {
+		if meta.ETag != "" {
+			header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, body, err := fetcher.get(ctx, url, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta != nil && resp.StatusCode == http.StatusNotModified {
+		return nil, resp, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return body, resp, nil
+}
+
+// cachePath возвращает путь к записи кэша без расширения. Имя файла - хэш адреса страницы
+func cachePath(dir, url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// readCache читает страницу и сведения о ней из кэша
+func readCache(path string) (cacheMeta, []byte, bool) {
+	var meta cacheMeta
+	data, err := ioutil.ReadFile(path + ".json")
+	if err != nil || json.Unmarshal(data, &meta) != nil {
+		return meta, nil, false
+	}
+	body, err := ioutil.ReadFile(path + ".html")
+	if err != nil {
+		return meta, nil, false
+	}
+	return meta, body, true
+}
+
+// writeCache записывает страницу и сведения о ней в кэш. Если body равен nil, записываются только сведения.
+// Сведения записываются последними: без них запись кэша не используется
+func writeCache(path string, meta cacheMeta, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if body != nil {
+		err := writeFileAtomic(path+".html", 0, func(w io.Writer) error {
+			_, err := w.Write(body)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path+".json", 0, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(meta)
+	})
+}
+
+// pruneHTTPCache удаляет записи кэша, которые давно не использовались
+func pruneHTTPCache(dir string) {
+	if dir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".json") || time.Since(f.ModTime()) < httpCacheMaxAge {
+			continue
+		}
+		path := filepath.Join(dir, strings.TrimSuffix(name, ".json"))
+		os.Remove(path + ".json")
+		os.Remove(path + ".html")
+	}
+}
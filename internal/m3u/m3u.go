@@ -0,0 +1,339 @@
+// Package m3u разбирает и записывает плейлисты в формате M3U (extended M3U).
+//
+// Плейлист разбирается в модель: заголовок #EXTM3U, записи (#EXTINF с продолжительностью, атрибутами и названием,
+// #EXTGRP, #EXTVLCOPT, прочие строки #EXT и ссылка) и остальные строки (комментарии, пустые строки).
+// Неизмененные элементы записываются обратно точно в том виде, в котором были прочитаны. Перевод строки
+// сохраняется для файла целиком: \r\n, если так заканчивается большинство строк, иначе \n.
+// Последняя строка при записи всегда заканчивается переводом строки.
+// Измененные и новые элементы записываются заново, значения атрибутов при этом экранируются.
+package m3u
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Attr атрибут строки #EXTM3U или #EXTINF: ключ="значение"
+type Attr struct {
+	Key      string
+	Value    string
+	Unquoted bool // значение было записано без кавычек. Так и записывается, если в нем нет пробелов, запятых и кавычек
+}
+
+// Attrs атрибуты в порядке следования в строке
+type Attrs []Attr
+
+// Get возвращает значение атрибута
+func (a Attrs) Get(key string) (string, bool) {
+	for _, attr := range a {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set задает значение атрибута. Существующий атрибут заменяется, новый добавляется в конец
+func (a *Attrs) Set(key, value string) {
+	for i := range *a {
+		if (*a)[i].Key == key {
+			(*a)[i].Value = value
+			return
+		}
+	}
+	*a = append(*a, Attr{Key: key, Value: value})
+}
+
+// Node элемент плейлиста: *Entry или *Text
+type Node interface {
+	lines() []string
+}
+
+// Header строка #EXTM3U
+type Header struct {
+	Line  int // номер строки в файле. 0 - заголовок создан программой
+	Attrs Attrs
+
+	raw    string // строка в том виде, в котором была прочитана
+	parsed string // та же строка, записанная заново сразу после разбора
+}
+
+// Text строка плейлиста, которая не относится к записи: комментарий, пустая строка, неизвестная директива
+type Text struct {
+	Line int // номер строки в файле. 0 - строка создана программой
+	Text string
+}
+
+// Entry запись плейлиста
+type Entry struct {
+	Line     int      // номер первой строки записи в файле. 0 - запись создана программой
+	Info     bool     // у записи есть строка #EXTINF
+	Duration float64  // продолжительность в секундах. -1 - неизвестна
+	Attrs    Attrs    // атрибуты строки #EXTINF
+	Title    string   // название записи
+	Group    string   // группа из строки #EXTGRP. Пустая строка - строки нет
+	VLCOpts  []string // значения строк #EXTVLCOPT
+	Extra    []string // прочие строки #EXT... записи как есть
+	URL      string   // ссылка. Пустая строка - у записи нет ссылки (конец файла)
+
+	raw    []string // строки записи в том виде, в котором были прочитаны
+	parsed []string // те же строки, записанные заново сразу после разбора
+}
+
+// Playlist плейлист
+type Playlist struct {
+	Header *Header // nil - в плейлисте нет строки #EXTM3U
+	Nodes  []Node
+	CRLF   bool // строки разделяются \r\n, как в прочитанном файле. false - \n
+}
+
+// Parse разбирает плейлист
+func Parse(r io.Reader) (*Playlist, error) {
+	p := &Playlist{}
+	var cur *Entry // запись, ссылка которой еще не прочитана
+	flush := func() {
+		if cur != nil {
+			cur.parsed = cur.encode()
+			p.Nodes = append(p.Nodes, cur)
+			cur = nil
+		}
+	}
+	start := func(n int) {
+		if cur == nil {
+			cur = &Entry{Line: n, Duration: -1}
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	crlf := 0 // строки, которые заканчиваются \r\n
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil && advance == len(token)+2 { // ScanLines отбрасывает \r перед \n
+			crlf++
+		}
+		return advance, token, err
+	})
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		n++
+		switch {
+		case n == 1 && strings.HasPrefix(strings.TrimPrefix(line, "\ufeff"), "#EXTM3U"):
+			p.Header = &Header{Line: n, raw: line}
+			p.Header.Attrs, _ = parseAttrs(strings.TrimPrefix(strings.TrimPrefix(line, "\ufeff"), "#EXTM3U"))
+			p.Header.parsed = p.Header.encode()
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if cur != nil && cur.Info {
+				flush() // у предыдущей записи нет ссылки
+			}
+			start(n)
+			e := ParseExtinf(line)
+			cur.Info, cur.Duration, cur.Attrs, cur.Title = true, e.Duration, e.Attrs, e.Title
+			cur.raw = append(cur.raw, line)
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			start(n)
+			cur.Group = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+			cur.raw = append(cur.raw, line)
+		case strings.HasPrefix(line, "#EXTVLCOPT:"):
+			start(n)
+			cur.VLCOpts = append(cur.VLCOpts, strings.TrimPrefix(line, "#EXTVLCOPT:"))
+			cur.raw = append(cur.raw, line)
+		case cur != nil && (strings.HasPrefix(line, "#EXT") || strings.HasPrefix(line, "#KODIPROP:")):
+			cur.Extra = append(cur.Extra, line)
+			cur.raw = append(cur.raw, line)
+		case strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "":
+			flush()
+			p.Nodes = append(p.Nodes, &Text{Line: n, Text: line})
+		default: // ссылка
+			start(n)
+			cur.URL = line
+			cur.raw = append(cur.raw, line)
+			flush()
+		}
+	}
+	flush()
+	p.CRLF = crlf*2 > n
+	return p, scanner.Err()
+}
+
+// ParseExtinf разбирает строку #EXTINF:<продолжительность> ключ="значение" ...,<название>.
+// Разбор нестрогий: то, что не удалось разобрать как атрибуты, попадает в название
+func ParseExtinf(line string) *Entry {
+	e := &Entry{Info: true, Duration: -1}
+	rest := strings.TrimPrefix(line, "#EXTINF:")
+
+	end := strings.IndexAny(rest, " \t,")
+	if end < 0 {
+		end = len(rest)
+	}
+	if d, err := strconv.ParseFloat(rest[:end], 64); err == nil {
+		e.Duration = d
+	}
+	rest = rest[end:]
+
+	var title string
+	e.Attrs, title = parseAttrs(rest)
+	e.Title = title
+	return e
+}
+
+// parseAttrs разбирает атрибуты ключ="значение" или ключ=значение до первой запятой вне кавычек.
+// Возвращает атрибуты и текст после запятой
+func parseAttrs(s string) (Attrs, string) {
+	var attrs Attrs
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return attrs, ""
+		}
+		if s[0] == ',' {
+			return attrs, s[1:]
+		}
+
+		end := strings.IndexAny(s, "= \t,")
+		if end < 0 || s[end] != '=' { // слово без значения. Не атрибут: дальше идет название
+			if comma := strings.IndexByte(s, ','); comma >= 0 {
+				return attrs, s[comma+1:]
+			}
+			return attrs, s
+		}
+		key := s[:end]
+		s = s[end+1:]
+
+		if !strings.HasPrefix(s, `"`) { // значение без кавычек - до пробела или запятой
+			end := strings.IndexAny(s, " \t,")
+			if end < 0 {
+				end = len(s)
+			}
+			attrs = append(attrs, Attr{Key: key, Value: s[:end], Unquoted: true})
+			s = s[end:]
+			continue
+		}
+		closing := strings.IndexByte(s[1:], '"')
+		if closing < 0 { // нет закрывающей кавычки. Значение - до конца строки
+			return append(attrs, Attr{Key: key, Value: s[1:]}), ""
+		}
+		attrs = append(attrs, Attr{Key: key, Value: s[1 : closing+1]})
+		s = s[closing+2:]
+	}
+}
+
+// EscapeValue готовит значение атрибута к записи: кавычки заменяются апострофами, переводы строк - пробелами
+func EscapeValue(s string) string {
+	return strings.Replace(EscapeText(s), `"`, "'", -1)
+}
+
+// EscapeText готовит текст к записи в одну строку плейлиста: переводы строк заменяются пробелами
+func EscapeText(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// encodeAttrs записывает атрибуты. Каждому атрибуту предшествует пробел
+func encodeAttrs(attrs Attrs) string {
+	var b strings.Builder
+	for _, attr := range attrs {
+		b.WriteString(" ")
+		b.WriteString(EscapeText(attr.Key))
+		b.WriteString("=")
+		if attr.Unquoted && attr.Value != "" && !strings.ContainsAny(attr.Value, " \t,\"\r\n") {
+			b.WriteString(attr.Value)
+			continue
+		}
+		b.WriteString(`"`)
+		b.WriteString(EscapeValue(attr.Value))
+		b.WriteString(`"`)
+	}
+	return b.String()
+}
+
+// encode записывает строку #EXTM3U
+func (h *Header) encode() string {
+	return "#EXTM3U" + encodeAttrs(h.Attrs)
+}
+
+// ExtinfLine возвращает строку #EXTINF записи
+func (e *Entry) ExtinfLine() string {
+	return "#EXTINF:" + strconv.FormatFloat(e.Duration, 'f', -1, 64) + encodeAttrs(e.Attrs) + "," + EscapeText(e.Title)
+}
+
+// encode записывает строки записи
+func (e *Entry) encode() []string {
+	var lines []string
+	if e.Info {
+		lines = append(lines, e.ExtinfLine())
+	}
+	if e.Group != "" {
+		lines = append(lines, "#EXTGRP:"+EscapeText(e.Group))
+	}
+	for _, opt := range e.VLCOpts {
+		lines = append(lines, "#EXTVLCOPT:"+EscapeText(opt))
+	}
+	for _, extra := range e.Extra {
+		lines = append(lines, EscapeText(extra))
+	}
+	if e.URL != "" {
+		lines = append(lines, strings.TrimSpace(EscapeText(e.URL)))
+	}
+	return lines
+}
+
+// lines возвращает строки записи. Неизмененная запись возвращается как была прочитана
+func (e *Entry) lines() []string {
+	lines := e.encode()
+	if e.raw != nil && equalLines(lines, e.parsed) {
+		return e.raw
+	}
+	return lines
+}
+
+// lines возвращает строку
+func (t *Text) lines() []string {
+	return []string{EscapeText(t.Text)}
+}
+
+// Lines возвращает все строки плейлиста
+func (p *Playlist) Lines() []string {
+	var lines []string
+	if p.Header != nil {
+		line := p.Header.encode()
+		if p.Header.raw != "" && line == p.Header.parsed {
+			line = p.Header.raw
+		}
+		lines = append(lines, line)
+	}
+	for _, node := range p.Nodes {
+		lines = append(lines, node.lines()...)
+	}
+	return lines
+}
+
+// Write записывает плейлист. Каждая строка заканчивается переводом строки: \r\n, если задан CRLF, иначе \n
+func (p *Playlist) Write(w io.Writer) error {
+	eol := "\n"
+	if p.CRLF {
+		eol = "\r\n"
+	}
+	bw := bufio.NewWriter(w)
+	for _, line := range p.Lines() {
+		if _, err := bw.WriteString(line + eol); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// equalLines сравнивает массивы строк
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package m3u
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// неизмененный плейлист записывается точно в том виде, в котором был прочитан
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"lf", "#EXTM3U x-tvg-url=\"http://epg/a.xml\"\n#EXTINF:-1 tvg-id=\"1\",Первый\nhttp://a/1\n"},
+		{"crlf", "#EXTM3U\r\n#EXTINF:-1 tvg-id=\"1\",Первый\r\nhttp://a/1\r\n#archive-begin-ntv\r\n#archive-end\r\n"},
+		{"bom", "\ufeff#EXTM3U\n#EXTINF:-1,Первый\nhttp://a/1\n"},
+		{"no header", "#EXTINF:-1,Первый\nhttp://a/1\n"},
+		{"extinf without url", "#EXTM3U\n#EXTINF:-1,Без ссылки\n#EXTINF:-1,Второй\nhttp://a/2\n#EXTINF:-1,Последний\n"},
+		{"comment between extinf and url", "#EXTM3U\n#EXTINF:-1,Первый\n# комментарий\nhttp://a/1\n"},
+		{"quotes and commas", "#EXTM3U\n#EXTINF:-1 tvg-name=\"A, B\" group-title=\"Кино (архив)\",Название, с запятой \"в кавычках\"\nhttp://a/1\n"},
+		{"unquoted values", "#EXTM3U\n#EXTINF:-1 crop=1920x1080+0+0 aspect-ratio=16:9,Первый\nhttp://a/1\n"},
+		{"entry lines", "#EXTM3U\n#EXTINF:0.5,Первый\n#EXTGRP:Новости\n#EXTVLCOPT:http-user-agent=VLC\n#KODIPROP:inputstream=adaptive\nhttp://a/1\n"},
+		{"blank lines", "#EXTM3U\n\n#EXTINF:-1,Первый\nhttp://a/1\n\n"},
+		{"unclosed quote", "#EXTM3U\n#EXTINF:-1 tvg-name=\"Первый,Первый\nhttp://a/1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := p.Write(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.in {
+				t.Errorf("записано:\n%q\nожидается:\n%q", out.String(), tt.in)
+			}
+		})
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	in := "#EXTM3U\n#EXTINF:-1 tvg-name=\"A, B\",Первый\n# комментарий\nhttp://a/1\n#EXTINF:10,Без ссылки\n"
+	p, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Nodes) != 4 {
+		t.Fatalf("элементов %d, ожидается 4", len(p.Nodes))
+	}
+	e, ok := p.Nodes[0].(*Entry)
+	if !ok || !e.Info || e.URL != "" || e.Title != "Первый" || e.Line != 2 {
+		t.Errorf("запись до комментария: %+v", p.Nodes[0])
+	}
+	if v, _ := e.Attrs.Get("tvg-name"); v != "A, B" {
+		t.Errorf("tvg-name = %q", v)
+	}
+	if text, ok := p.Nodes[1].(*Text); !ok || text.Text != "# комментарий" || text.Line != 3 {
+		t.Errorf("комментарий: %+v", p.Nodes[1])
+	}
+	if e, ok := p.Nodes[2].(*Entry); !ok || e.Info || e.URL != "http://a/1" {
+		t.Errorf("ссылка после комментария: %+v", p.Nodes[2])
+	}
+	if e, ok := p.Nodes[3].(*Entry); !ok || e.Duration != 10 || e.URL != "" {
+		t.Errorf("запись без ссылки: %+v", p.Nodes[3])
+	}
+}
+
+func TestParseExtinf(t *testing.T) {
+	tests := []struct {
+		line     string
+		duration float64
+		attrs    Attrs
+		title    string
+	}{
+		{"#EXTINF:-1,Первый", -1, nil, "Первый"},
+		{"#EXTINF:0 tvg-id=\"1\" tvg-name=\"A, B\",Название", 0, Attrs{{Key: "tvg-id", Value: "1"}, {Key: "tvg-name", Value: "A, B"}}, "Название"},
+		{"#EXTINF:12.5 crop=1920x1080+0+0,Название, с запятой", 12.5, Attrs{{Key: "crop", Value: "1920x1080+0+0", Unquoted: true}}, "Название, с запятой"},
+		{"#EXTINF:-1 слово,Название", -1, nil, "Название"},
+		{"#EXTINF:abc,Название", -1, nil, "Название"},
+	}
+	for _, tt := range tests {
+		e := ParseExtinf(tt.line)
+		if e.Duration != tt.duration || e.Title != tt.title || len(e.Attrs) != len(tt.attrs) {
+			t.Errorf("%s: продолжительность %v, название %q, атрибуты %v", tt.line, e.Duration, e.Title, e.Attrs)
+			continue
+		}
+		for i := range tt.attrs {
+			if e.Attrs[i] != tt.attrs[i] {
+				t.Errorf("%s: атрибут %d = %+v, ожидается %+v", tt.line, i, e.Attrs[i], tt.attrs[i])
+			}
+		}
+	}
+}
+
+// измененная запись записывается заново, значения экранируются, остальные строки не меняются
+func TestModifiedEntry(t *testing.T) {
+	in := "#EXTM3U\r\n#EXTINF:-1 tvg-id=\"1\" crop=1920x1080+0+0,Первый\r\nhttp://a/1\r\n#EXTINF:-1,Второй\r\nhttp://a/2\r\n"
+	p, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := p.Nodes[0].(*Entry)
+	e.Attrs.Set("group-title", "Кино \"новое\",\nархив")
+	e.Attrs.Set("tvg-id", "2")
+
+	var out bytes.Buffer
+	if err := p.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\r\n#EXTINF:-1 tvg-id=\"2\" crop=1920x1080+0+0 group-title=\"Кино 'новое', архив\",Первый\r\nhttp://a/1\r\n#EXTINF:-1,Второй\r\nhttp://a/2\r\n"
+	if out.String() != want {
+		t.Errorf("записано:\n%q\nожидается:\n%q", out.String(), want)
+	}
+}
+
+func TestNewPlaylist(t *testing.T) {
+	p := &Playlist{Header: &Header{}}
+	p.Nodes = append(p.Nodes, &Text{Text: "#archive-begin-ntv"}, &Text{Text: "#archive-end"})
+	e := ParseExtinf("#EXTINF:-1 group-title=\"Архив\",Передача")
+	e.Duration = 3600
+	e.URL = "http://a/1"
+	p.Nodes = append(p.Nodes, e)
+
+	var out bytes.Buffer
+	if err := p.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#archive-begin-ntv\n#archive-end\n#EXTINF:3600 group-title=\"Архив\",Передача\nhttp://a/1\n"
+	if out.String() != want {
+		t.Errorf("записано:\n%q\nожидается:\n%q", out.String(), want)
+	}
+}
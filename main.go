@@ -2,18 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"github.com/PuerkitoBio/goquery"
+	"github.com/Dremalka/updplaylist/internal/m3u"
 	"github.com/go-ini/ini"
+	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -30,6 +36,9 @@ type progr struct {
 	day            string
 	dayOfWeek      string
 	dataProgr      time.Time
+	endpr          time.Time    // время окончания передачи. Нулевое, если неизвестно
+	group          string       // группа записей архива канала из настроек
+	details        progrDetails // подробности о передаче. Запрашиваются, если в настройках задано details = true
 }
 
 // структура записи канала
@@ -40,6 +49,8 @@ type listDay struct {
 	dayOfWeek   string
 	url         string
 	dataProgr   time.Time
+	provider    string // имя поставщика программы передач канала
+	group       string // группа записей архива канала из настроек
 }
 
 // настройки
@@ -49,6 +60,47 @@ type settings struct {
 	pathplaylist string
 	channels     []*ini.Key
 	workers      int
+	provider     string                      // поставщик программы передач по умолчанию
+	xmltv        string                      // имя XMLTV-файла. Пустая строка - файл не создается
+	xmltvgzip    bool                        // сжимать XMLTV-файл gzip
+	xmltvsource  string                      // XMLTV-источник программы передач: путь к файлу или URL
+	httpaddr     string                      // адрес http-сервера
+	httppath     string                      // путь, по которому http-сервер отдает плейлист. Пустая строка - не отдавать
+	pltemplate   string                      // файл-заготовка для создания плейлиста, если его нет. Пустая строка - создать пустой
+	backups      int                         // количество резервных копий плейлиста
+	streamurl    *template.Template          // шаблон ссылки на запись передачи по умолчанию
+	extinf       *template.Template          // шаблон атрибутов и названия записи передачи в строке #EXTINF по умолчанию
+	archivemode  string                      // режим вывода архива: programs, catchup или both
+	anchorplace  string                      // куда ставить строки-якоря новых каналов: end или entry
+	orphans      string                      // что делать со строками-якорями каналов, которых нет в секции channels: keep, remove или comment
+	catchupsrc   *template.Template          // шаблон атрибута catchup-source записи канала
+	archivedays  int                         // глубина архива в днях по умолчанию. 0 - все дни, которые отдает поставщик
+	airedonly    bool                        // выводить только закончившиеся передачи
+	lastduration int                         // продолжительность последней передачи дня в минутах, если ее окончание неизвестно
+	details      bool                        // запрашивать подробности о передачах со страниц передач
+	cachedir     string                      // каталог кэша страниц сайта. Пустая строка - не кэшировать
+	cachettl     int                         // сколько секунд страница сегодняшнего или будущего дня в кэше считается свежей
+	store        string                      // файл хранилища программы передач. Пустая строка - программа передач не накапливается
+	retention    int                         // срок хранения программы передач в днях по умолчанию. 0 - без ограничения
+	timeout      int                         // время ожидания ответа сайта в секундах. 0 - без ограничения
+	retries      int                         // количество повторов неудачного запроса
+	rps          float64                     // не больше стольких запросов в секунду к одному сайту. 0 - без ограничения
+	useragent    string                      // заголовок User-Agent запросов
+	proxy        *url.URL                    // прокси-сервер. nil - из переменных окружения
+	chset        map[string]*channelSettings // настройки отдельных каналов. Ключ - название канала
+}
+
+// настройки отдельного канала
+type channelSettings struct {
+	provider  string             // имя поставщика программы передач
+	xmltvid   string             // идентификатор канала в XMLTV-источнике
+	streamurl *template.Template // шаблон ссылки на запись передачи
+	extinf    *template.Template // шаблон атрибутов и названия записи передачи в строке #EXTINF
+	name      string             // название канала вместо полученного от поставщика. Пустая строка - не заменять
+	group     string             // группа записей архива (group-title). Пустая строка - "<название канала> (архив)"
+	days      int                // глубина архива в днях. По умолчанию archivedays. 0 - все дни, которые отдает поставщик
+	enabled   bool               // канал включен
+	retention int                // срок хранения программы передач в днях. По умолчанию retention секции general
 }
 
 const (
@@ -56,20 +108,64 @@ const (
 	defUpdSetDelay  = "600"             // периодичность с которой перечитывать файл с настройками
 	defUpdDataDelay = "3600"            // периодичность с которой обновлять плейлист
 	defPathPlaylist = "playlist.m3u"    // имя файла-плейлиста
+	defHTTPAddr     = "0.0.0.0:6060"    // адрес http-сервера
+	defHTTPPath     = "/playlist.m3u"   // путь, по которому http-сервер отдает плейлист
+	defBackups      = "3"               // количество резервных копий плейлиста
+	defArchiveDays  = "0"               // глубина архива в днях. 0 - без ограничения
+	defAiredOnly    = "false"           // выводить только закончившиеся передачи. По умолчанию выводятся все передачи
+	defLastDuration = "60"              // продолжительность последней передачи дня в минутах
+	defDetails      = "false"           // запрашивать подробности о передачах
+	defCacheDir     = ""                // каталог кэша страниц сайта. По умолчанию страницы не сохраняются
+	defCacheTTL     = "1800"            // время жизни страниц сегодняшнего и будущих дней в кэше
+	defStore        = ""                // файл хранилища программы передач. По умолчанию хранилище не используется
+	defRetention    = "30"              // срок хранения программы передач в днях
+	defTimeout      = "30"              // время ожидания ответа сайта в секундах
+	defRetries      = "3"               // количество повторов неудачного запроса
+	defRPS          = "2"               // запросов в секунду к одному сайту
 )
 
+const defUserAgent = "updplaylist (+https://github.com/Dremalka/updplaylist)" // заголовок User-Agent запросов к сайтам
+
 var defWorkers = runtime.NumCPU() // количество параллельных потоков при загрузке данных с сайта www.cn.ru
 
 var cf *ini.File      // объект пакета ini с данными настройки
 var cfstruct settings // настройки программы
 var mutex = &sync.Mutex{}
-var chPr map[string][]progr // отображение массивов с данными программы передач
+var chPr map[string][]progr     // отображение массивов с данными программы передач
+var chPrUpdated time.Time       // время последнего обновления chPr
+var viewSettings settings       // копия настроек для http-сервера
+var viewMutex = &sync.RWMutex{} // защищает chPr, chPrUpdated и viewSettings. Http-сервер не должен ждать, пока updProgr держит mutex
 
 func main() {
+	nostdin := flag.Bool("nostdin", false, "не ждать нажатия Enter: работать до сигнала SIGINT/SIGTERM (для systemd, docker)")
+	flag.Usage = usage
+	flag.Parse()
 
-	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-	}()
+	cmd := "run"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+	}
+	switch cmd {
+	case "run":
+		os.Exit(cmdRun(*nostdin))
+	case "once":
+		os.Exit(cmdOnce())
+	case "validate":
+		os.Exit(cmdValidate())
+	case "rollback":
+		os.Exit(cmdRollback(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Неизвестная команда %q\n", cmd)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// cmdRun работает в режиме службы: периодически перечитывает настройки и обновляет плейлист до сигнала или нажатия Enter
+func cmdRun(nostdin bool) int {
+	// по сигналу SIGINT/SIGTERM отменить контекст. Текущее обновление плейлиста прерывается, горутины завершаются
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	cfstruct = settings{}
 
@@ -77,269 +173,275 @@ func main() {
 	var err error
 	err = reloadSettings()
 	if err != nil {
-		log.Panicln("Ошибка при загрузке файла с настройками:", err)
+		fmt.Fprintln(os.Stderr, "Ошибка при загрузке файла с настройками:", err)
+		return exitUsage // прежних настроек нет, работать не с чем
 	}
+	publishSettings()
 
-	go updSettings() // горутина периодически перечитывает настройки
-	go updProgr()    // горутина периодически собирает данные с сайта и обновляет плейлист
+	srv := &http.Server{Addr: cfstruct.httpaddr, Handler: newHTTPHandler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { // горутина периодически перечитывает настройки
+		defer wg.Done()
+		updSettings(ctx)
+	}()
+	go func() { // горутина периодически собирает данные с сайта и обновляет плейлист
+		defer wg.Done()
+		updProgr(ctx)
+	}()
 
 	// для выхода из программы ждать нажатия кнопки
-	var response string
-	fmt.Println("Press Enter")
-	_, _ = fmt.Scanln(&response)
-	fmt.Println("Exit.")
+	if !nostdin {
+		go func() {
+			var response string
+			fmt.Println("Press Enter")
+			if _, err := fmt.Scanln(&response); err == io.EOF {
+				return // stdin закрыт. Работать до сигнала
+			}
+			stop()
+		}()
+	}
 
-}
+	<-ctx.Done()
+	log.Println("Завершение работы")
 
-// reload считывает данные с ini-файла и загружает в структуру. При необходимости инициализирует данные значениями по умолчанию
-func reloadSettings() error {
-	var key *ini.Key
-	var err error
-	var value int
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Ошибка при остановке http-сервера:", err)
+	}
+	cancel()
 
-	defUpdSetDelayInt, _ := strconv.Atoi(defUpdSetDelay)
-	defUpdDataDelayInt, _ := strconv.Atoi(defUpdDataDelay)
+	wg.Wait() // дождаться, пока прервется текущее обновление плейлиста
+	closeStore()
+	fmt.Println("Exit.")
+	return exitOK
+}
 
-	// открыть ini-файл
-	cf, err = ini.Load(nameIniFile)
-	if err != nil {
-		if os.IsNotExist(err) { // файл с настройками не найден?
-			cf = ini.Empty() // создать новый объект с настройками
-		} else {
-			return err
+// updProgr с заданной периодичностью обновляет плейлист. Между плановыми обновлениями выполняет внеочередные запросы после изменения настроек.
+// Все обновления выполняются по очереди в этой горутине, поэтому два обновления никогда не пишут плейлист одновременно
+func updProgr(ctx context.Context) {
+	req := rebuildRequest{full: true}
+	var nextFull time.Time // время следующего планового обновления
+	for {
+		var err error
+		switch {
+		case req.full:
+			_, err = updatePlaylist(ctx, nil)
+			mutex.Lock() // настройки заменяет updSettings
+			delay := time.Duration(cfstruct.upddatadelay) * time.Second
+			mutex.Unlock()
+			nextFull = time.Now().Add(delay)
+		case len(req.channels) > 0:
+			_, err = updatePlaylist(ctx, req.channels)
+		default:
+			err = rewritePlaylist()
 		}
-	}
-
-	// обработать секцию "general" с основными настройками
-	section, err := cf.GetSection("general")
-	if err != nil {
-		section, err = cf.NewSection("general") // секции нет в ini-файле? Тогда создать.
 		if err != nil {
-			return err // если не удалось создать, то продолжать бессмысленно
+			log.Println("Ошибка при обновлении плейлиста:", err)
 		}
-		section.Comment = "Основные настройки"
-	}
 
-	// перечитывать настройки каждые .... сек
-	key, err = section.GetKey("updsetdelay")
-	if err != nil {
-		key, err = section.NewKey("updsetdelay", defUpdSetDelay)
-		if err != nil {
-			return err
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-rebuild:
+		case <-time.After(time.Until(nextFull)):
+			req = rebuildRequest{full: true}
 		}
-		key.Comment = "Перечитывать настройки каждые ... сек."
 	}
-	value = key.RangeInt(defUpdSetDelayInt, 5, 1000000) // значение в пределах 5 - 1000000 секунд. При ошибке инициализация значением по умолчанию
-	key.SetValue(strconv.Itoa(value))
-	cfstruct.updsetdelay = value
+}
 
-	// обновлять данные плейлиста каждые .... сек
-	key, err = section.GetKey("upddatadelay")
-	if err != nil {
-		key, err = section.NewKey("upddatadelay", defUpdDataDelay)
-		if err != nil {
-			return err
-		}
-		key.Comment = "Обновлять данные плейлиста каждые ... сек."
+// updatePlaylist собирает данные с сайта и обновляет плейлист. При отмене ctx обновление прерывается, плейлист не изменяется.
+// Если задан only, программа передач запрашивается только для этих каналов, для остальных берутся ранее собранные данные.
+// Возвращает каналы, по которым не удалось получить программу передач, и ошибку, если плейлист не обновлен
+func updatePlaylist(ctx context.Context, only []string) ([]string, error) {
+	if only == nil {
+		log.Println("Обновляется плейлист")
+	} else {
+		log.Println("Обновляется плейлист. Программа передач запрашивается для каналов:", strings.Join(only, ", "))
 	}
-	value = key.RangeInt(defUpdDataDelayInt, 300, 1000000) // значение в пределах 300 - 1000000 секунд. При ошибке инициализация значением по умолчанию
-	key.SetValue(strconv.Itoa(value))
-	cfstruct.upddatadelay = value
+	mutex.Lock()
+	defer mutex.Unlock()
 
-	// Имя файла плейлиста и путь до него.
-	key, err = section.GetKey("pathplaylist")
-	if err != nil {
-		key, err = section.NewKey("pathplaylist", defPathPlaylist)
-		if err != nil {
-			return err
-		}
-		key.Comment = "Имя файла плейлиста и путь до него."
+	failed := &fetchFailures{} // каналы, по которым не удалось получить программу передач
+
+	channels := cfstruct.channels
+	if only != nil {
+		channels = filterChannels(channels, only)
 	}
-	cfstruct.pathplaylist = key.String()
 
-	// Количество параллельных потоков для парсинга сайта
-	key, err = section.GetKey("workers")
-	if err != nil {
-		key, err = section.NewKey("workers", strconv.Itoa(defWorkers))
-		if err != nil {
-			return err
+	if cfstruct.details && cfstruct.store != "" { // подробности о передачах, полученные при прошлых запусках, берутся из хранилища
+		if err := openStore(cfstruct.store); err != nil {
+			log.Println(err)
 		}
-		key.Comment = "Количество параллельных потоков для парсинга сайта. По умолчанию равен кол-ву ядер процессора."
+	}
+
+	channelInCollectDataProgr := make(chan progr, 200) // канал по которому пул горутин передает сборщику записи с данными по каждой программе передач
+	done := make(chan map[string][]progr)              // канал по которому сборщик данных передает текущей функции все собранные данные
 
+	go collectDataProgr(channelInCollectDataProgr, done) // запустить сборщик данных
+
+	listURL := getListURL(ctx, channels, failed) // получить массив с данными (включая ссылку на страницу) для каждого дня заданных каналов
+
+	chURL := make(chan listDay) // канал по которому пулу горутин передается структура с данными (включая ссылку на страницу) каждого дня канала
+	var wg sync.WaitGroup
+	for i := 0; i < cfstruct.workers; i++ { // создать пул горутин
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getProgr(ctx, chURL, channelInCollectDataProgr, failed)
+		}()
 	}
-	value = key.RangeInt(defWorkers, 1, 100) // значение в пределах 1 - 100 отдельных потоков. При ошибке инициализация значением по умолчанию
-	key.SetValue(strconv.Itoa(value))
-	cfstruct.workers = value
 
-	// секция "каналы"
-	section, err = cf.GetSection("channels")
-	if err != nil {
-		section, err = cf.NewSection("channels") // секции нет в ini-файле? Создать секцию.
-		if err != nil {
-			return err
+send:
+	for _, rec := range listURL {
+		select {
+		case chURL <- rec: // передать горутинам все ссылки (для каждого канала, каждый день)
+		case <-ctx.Done():
+			break send
 		}
 	}
-	section.Comment = "Список каналов. Пример строки: -:rossija"
+	close(chURL)                     // за ненадобностью закрыть канал
+	wg.Wait()                        // дождаться завершения всех горутин пула
+	close(channelInCollectDataProgr) // после этого сборщик заберет оставшиеся записи и завершит работу
+	data := <-done                   // ждать от сборщика собранные данные
 
-	// секция содержит список каналов
-	ch := section.Keys() // получить массив списка каналов
-	cfstruct.channels = ch
-
-	err = cf.SaveTo(nameIniFile) // сохранить файл с значениями по умолчанию
-	if err != nil {
-		return err
+	if ctx.Err() != nil {
+		return failed.list(), fmt.Errorf("обновление плейлиста прервано")
 	}
 
-	return nil
-}
+	lastDuration := time.Duration(cfstruct.lastduration) * time.Minute
+	for key, vol := range data { // каждый массив программ передач канала
+		sortProgr(vol)                 // рассортировать
+		setEndTimes(vol, lastDuration) // и рассчитать время окончания передач
+		data[key] = vol
+	}
 
-// updSettings с заданной перидочностью из ini-файла обновляет настройки
-func updSettings() {
-	for {
-		mutex.Lock()
-		err := reloadSettings()
+	// сохранить программу передач в хранилище и взять из него накопленную за прошлые обновления
+	stored := false
+	if cfstruct.store != "" {
+		all, err := syncStore(data, &cfstruct, time.Now())
 		if err != nil {
-			log.Panicln("Ошибка при загрузке файла с настройками:", err)
+			log.Println(err) // плейлист формируется из только что полученных данных
+		} else {
+			for _, vol := range all {
+				sortProgr(vol)
+			}
+			data = all
+			stored = true
 		}
-		mutex.Unlock()
-		log.Println("Настройки обновлены")
-		time.Sleep(time.Duration(cfstruct.updsetdelay) * time.Second)
 	}
-}
-
-// updProgr с заданной периодичностью обновляет плейлист
-func updProgr() {
-	for {
-		log.Println("Обновляется плейлист")
-		mutex.Lock()
 
-		channelInCollectDataProgr := make(chan progr, 200) // канал по которому пул горутин передает сборщику записи с данными по каждой программе передач
-		channelDoneCollectDataProgr := make(chan struct{}) // канал по которому каждая горутина сообщают сборщику о прекращении обработки данных и закрытии
-		done := make(chan struct{})                        // канал по которому сборщик данных сообщает текущей функции о том, что все данные собраны
-
-		go collectDataProgr(channelInCollectDataProgr, channelDoneCollectDataProgr, done) // запустить сборщик данных
-
-		listURL := getListURL(cfstruct.channels) // получить массив с данными (включая ссылку на страницу) для каждого дня заданных каналов
-
-		chURL := make(chan listDay)             // канал по которому пулу горутин передается структура с данными (включая ссылку на страницу) каждого дня канала
-		for i := 0; i < cfstruct.workers; i++ { // создать пул горутин
-			go getProgr(chURL, channelInCollectDataProgr, channelDoneCollectDataProgr)
+	viewMutex.Lock()
+	if only != nil && !stored { // данные остальных каналов взять из прежнего обновления
+		fetched := make(map[string]bool)
+		for _, ch := range only {
+			fetched[ch] = true
 		}
-
-		for _, rec := range listURL {
-			chURL <- rec // передать горутинам все ссылки (для каждого канала, каждый день)
+		for ch, vol := range chPr {
+			if !fetched[ch] {
+				data[ch] = vol
+			}
 		}
-		close(chURL) // за ненадобностью закрыть канал
-		<-done       // и ждать завершения работы сборщика
-
-		close(channelInCollectDataProgr) // закрыть все созданные каналы
-		close(channelDoneCollectDataProgr)
-		close(done)
+	}
+	data = pruneData(data, cfstruct.channels) // данные удаленных из настроек каналов больше не нужны
+	pruneDetails(data)                        // и подробности о передачах, которых больше нет
+	if only == nil {
+		pruneHTTPCache(cfstruct.cachedir) // и давно не используемые страницы в кэше
+	}
 
-		// настроить условия сортировки массива с основными данными и рассортировать подготовленные данные
-		dataProg := func(c1, c2 *progr) bool { // дни программы передач сортировать по убыванию (... 5, 4, 3, 2,..,)
-			return c1.dataProgr.After(c2.dataProgr)
-		}
+	// отдать собранные данные http-серверу
+	chPr = data
+	chPrUpdated = time.Now()
+	viewMutex.Unlock()
 
-		datepr := func(c1, c2 *progr) bool { // дни внутри одного дня программы передач сортировать по возрастанию. Бывает, что в программе передач передачи заканчиваются ночью следующего дня
-			return c1.datepr.Before(c2.datepr)
-		}
+	if err := writeOutputs(data); err != nil {
+		return failed.list(), err
+	}
 
-		timepr := func(c1, c2 *progr) bool { // время внутри одного дня программы передач сортировать возрастанию.
-			return c1.timepr.Before(c2.timepr)
-		}
+	log.Println("Обновление плейлиста завершено")
+	return failed.list(), nil
+}
 
-		for key, vol := range chPr { // каждый массив программ передач канала
-			orderBy(dataProg, datepr, timepr).Sort(vol) // рассортировать понастроенным выше правилам
-			chPr[key] = vol
-		}
+// rewritePlaylist заново формирует плейлист из ранее собранных данных, не запрашивая программу передач
+func rewritePlaylist() error {
+	log.Println("Плейлист формируется заново из ранее собранных данных")
+	mutex.Lock()
+	defer mutex.Unlock()
 
-		// обработка плейлиста
-		linesText, err := readLines(cfstruct.pathplaylist) // прочитать плейлист
-		if err != nil {
-			log.Println("Ошибка при открытии и считывании плейлиста:", err)
-		} else {
-			linesText, err = checkLines(linesText) // удалить старые данные между строками-якорями. Создать новые строки-якори для новых каналов (#archive-begin-rossija, #archive-end,...)
-			if err != nil {
-				log.Println("Ошибка при подготовке плейлиста к обновлению:", err)
-			} else {
-				// обойти все строки плейлиста. При получении строки-якоря заполнить новыми данными
-				var newlinesText []string
-			loop:
-				for _, str := range linesText {
-					newlinesText = append(newlinesText, str)      // обычные строки плейлиста. Не обрабатываются.
-					if strings.HasPrefix(str, "#archive-begin") { // строка-якорь начала данных определенного канала
-						strSplit := strings.Split(str, "-")
-						if len(strSplit) != 3 {
-							log.Printf("Ошибка в строке: %s. Правильный пример: #archive-begin-rossija\n", str)
-							continue loop
-						}
-						ch := strSplit[2] // получить название канала
-						flag := true
-						for _, vol := range chPr[ch] { // найти в отображении массив данных заданного канала
-							var serviceInf string
-							if flag { // в первой строке нужно задать имя группы
-								serviceInf = `crop=1920x1080+0+0 aspect-ratio=16:9 group-title="` + vol.nameChannel + ` (архив)",`
-								flag = false
-							} else {
-								serviceInf = "crop=1920x1080+0+0 aspect-ratio=16:9,"
-							}
-
-							// сформировать две строки в формате m3u
-							firststr := "#EXTINF:-1 " + serviceInf + vol.day + " " + vol.dayOfWeek + " " + vol.timeBeginProgr + ` "` + vol.nameProgr + `"`
-							newlinesText = append(newlinesText, firststr)
-
-							secondstr := "http://hls.peers.tv/playlist/program/" + vol.idProgr + ".m3u8"
-							newlinesText = append(newlinesText, secondstr)
-						}
-					}
-				}
-				linesText = newlinesText
+	viewMutex.Lock()
+	data := pruneData(chPr, cfstruct.channels)
+	chPr = data
+	viewMutex.Unlock()
 
-				// записать обновленный плейлист в файл
-				err := writeLines(linesText, cfstruct.pathplaylist)
-				if err != nil {
-					log.Printf("Ошибка при записи новых данных в файл %s.\n", cfstruct.pathplaylist)
-				}
+	if err := writeOutputs(data); err != nil {
+		return err
+	}
+	log.Println("Обновление плейлиста завершено")
+	return nil
+}
 
-			}
+// writeOutputs записывает XMLTV-файл и плейлист, заполненный данными программы передач. Вызывается при захваченном mutex
+func writeOutputs(data map[string][]progr) error {
+	// записать программу передач в формате XMLTV
+	if cfstruct.xmltv != "" {
+		path := xmltvPath(cfstruct.xmltv, cfstruct.pathplaylist, cfstruct.xmltvgzip)
+		if err := writeXMLTV(data, path, cfstruct.xmltvgzip); err != nil {
+			log.Printf("Ошибка при записи программы передач в файл %s: %v\n", path, err)
 		}
-		mutex.Unlock()
-		log.Println("Обновление плейлиста завершено")
+	}
 
-		time.Sleep(time.Duration(cfstruct.upddatadelay) * time.Second)
+	// обработка плейлиста
+	playlist, err := loadPlaylist(&cfstruct, log.Printf) // прочитать плейлист. Если его нет - создать
+	if err != nil {
+		return fmt.Errorf("не удалось прочитать плейлист: %v", err)
 	}
-}
+	playlist, err = checkLines(playlist, &cfstruct, data, log.Printf) // удалить старые данные между строками-якорями. Создать новые строки-якори для новых каналов (#archive-begin-rossija, #archive-end,...)
+	if err != nil {
+		return fmt.Errorf("не удалось подготовить плейлист к обновлению: %v", err)
+	}
+	playlist = renderPlaylist(playlist, data, &cfstruct, log.Printf) // заполнить блоки между строками-якорями новыми данными
 
-// collectDataProg сборщик собирает из канала записи и складывает в массив
-func collectDataProgr(in <-chan progr, done <-chan struct{}, genDone chan<- struct{}) {
-	chPr = make(map[string][]progr) // отображение. В качестве ключа - название канала. Значение - массив с данными по каналу
-	workers := cfstruct.workers     // количество горутин. По количеству определяется момент, когда необходимо завершить работу.
-loop:
-	for {
-		select {
-		case recpr := <-in: // полученную запись из канала
-			chPr[recpr.channel] = append(chPr[recpr.channel], recpr) // сохранить в массив
+	// записать обновленный плейлист в файл
+	err = writePlaylist(playlist, cfstruct.pathplaylist, cfstruct.backups)
+	if err != nil {
+		return fmt.Errorf("не удалось записать плейлист в файл %s: %v", cfstruct.pathplaylist, err)
+	}
+	return nil
+}
 
-		case <-done: // горутина вернула сигнал о завершении работы
-			workers--
-			if workers <= 0 { // как только все горутины вернут сигнал о завершении
-				break loop // прервать цикл
-			}
-		}
+// collectDataProg сборщик собирает из канала записи и складывает в массив. Канал закрывается, когда все горутины пула завершили работу
+func collectDataProgr(in <-chan progr, genDone chan<- map[string][]progr) {
+	data := make(map[string][]progr) // отображение. В качестве ключа - название канала. Значение - массив с данными по каналу
+	for recpr := range in {          // полученную запись из канала
+		data[recpr.channel] = append(data[recpr.channel], recpr) // сохранить в массив
 	}
-	genDone <- struct{}{} // отправить сигнал о завершении вызываемой функции
-	return
+	genDone <- data // отправить собранные данные вызываемой функции
 }
 
 // getProg по каждому дню получает массив данных программы передач. Собранные данные отправляет по каналу сборщику. URL страницы получает из канала
-func getProgr(in <-chan listDay, out chan<- progr, done chan<- struct{}) {
+func getProgr(ctx context.Context, in <-chan listDay, out chan<- progr, failed *fetchFailures) {
 
 loop:
 	for thisDay := range in { // получить очередной URL страницы
-		listProgr, err := getListProgr(thisDay.url) // URL передать функции. Обратно получить массив с данными.
+		if ctx.Err() != nil { // обновление прервано. Оставшиеся дни пропустить
+			continue loop
+		}
+		p, err := getProvider(thisDay.provider)
+		if err != nil {
+			log.Printf("Ошибка при получении данных программы передач. Канал = %s: %v\n", thisDay.channel, err)
+			failed.add(thisDay.channel)
+			continue loop
+		}
+		listProgr, err := p.listProgr(ctx, thisDay) // день передать поставщику. Обратно получить массив с данными.
 		if err != nil {
 			log.Printf("Ошибка при получении данных программы передач. Канал = %s, URL=%s\n", thisDay.channel, thisDay.url)
+			failed.add(thisDay.channel)
 			continue loop
 		}
 		for _, vol := range listProgr { // каждую запись программы сформировать отдельно
@@ -349,93 +451,316 @@ loop:
 			progr.datepr = vol.datepr
 			progr.timepr = vol.timepr
 			progr.timeBeginProgr = vol.timeBeginProgr
+			progr.endpr = vol.endpr
 			progr.idProgr = vol.idProgr
 			progr.nameProgr = vol.nameProgr
 			progr.hrefProgr = vol.hrefProgr
 			progr.day = thisDay.day
 			progr.dayOfWeek = thisDay.dayOfWeek
 			progr.dataProgr = thisDay.dataProgr
+			progr.group = thisDay.group
+			progr.details = vol.details
+			if cfstruct.details {
+				enrichProgr(ctx, p, &progr) // описание, жанр, постер и т.п. со страницы передачи
+			}
 			out <- progr // и отправить сборщику
 		}
 
 	}
-	done <- struct{}{}
-
-	return
 }
 
-// getListUrl парсит основную страницу канала. Получает ссылки на каждый день программы передач.
-func getListURL(channelsKeys []*ini.Key) []listDay {
+// getListURL у поставщика каждого канала получает ссылки на каждый день программы передач.
+func getListURL(ctx context.Context, channelsKeys []*ini.Key, failed *fetchFailures) []listDay {
 	var list []listDay
 loop:
 	for _, channelKey := range channelsKeys {
+		if ctx.Err() != nil {
+			break loop
+		}
 		channel := channelKey.Value()
-		doc, err := goquery.NewDocument("http://www.cn.ru/tv/program/" + channel + "/")
+		chs, ok := cfstruct.chset[channel]
+		if !ok {
+			chs = &channelSettings{provider: defProvider, days: cfstruct.archivedays, retention: cfstruct.retention, enabled: true}
+		}
+		name := chs.provider
+		p, err := getProvider(name)
+		if err != nil {
+			log.Printf("Ошибка при получении ссылок на каждый день программы передач. Канал = %s: %v\n", channel, err)
+			failed.add(channel)
+			continue loop
+		}
+		days, err := p.listDays(ctx, channel)
 		if err != nil {
 			log.Printf("Ошибка при получении ссылок на каждый день программы передач. Канал = %s.\n", channel)
+			failed.add(channel)
 			continue loop
 		}
+		if chs.days > 0 {
+			days = recentDays(days, chs.days, time.Now()) // оставить только дни в пределах глубины архива
+		}
+		for i := range days {
+			days[i].provider = name
+			days[i].group = chs.group
+			if chs.name != "" {
+				days[i].nameChannel = chs.name
+			}
+		}
+		list = append(list, days...)
+	}
 
-		nameChannel := doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content h2.prg-channel span").Text()
+	return list
+}
 
-		doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content #mtvprg-week.prg-week a").Each(func(i int, s *goquery.Selection) {
-			if articleURL, ok := s.Attr("href"); ok {
-				thisDay := listDay{}
-				thisDay.nameChannel = nameChannel
-				articleURLSplit := strings.Split(articleURL, "/")
-				thisDay.dataProgr, _ = time.Parse("2006-01-02", articleURLSplit[len(articleURLSplit)-2])
-				thisDay.channel = channel
-				thisDay.url = articleURL
-				thisDay.day = s.Find("strong").Text()
-				thisDay.dayOfWeek = s.Find("small").Text()
-				list = append(list, thisDay)
-			}
-		})
+// fetchFailures собирает каналы, по которым не удалось получить программу передач. Используется горутинами пула одновременно
+type fetchFailures struct {
+	sync.Mutex
+	channels map[string]bool
+}
+
+// add отмечает канал как неудачный
+func (f *fetchFailures) add(channel string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.channels == nil {
+		f.channels = make(map[string]bool)
 	}
+	f.channels[channel] = true
+}
 
+// list возвращает отсортированный список неудачных каналов
+func (f *fetchFailures) list() []string {
+	f.Lock()
+	defer f.Unlock()
+	var list []string
+	for ch := range f.channels {
+		list = append(list, ch)
+	}
+	sort.Strings(list)
 	return list
 }
 
-// getListProgr запрашивает html-страницу. Парсит и собирает данные по программам в массив
-func getListProgr(url string) ([]progr, error) {
-	var listProgr []progr
-	sourceURL := "http://www.cn.ru" + url
+// renderPlaylist обходит все строки плейлиста. После каждой строки-якоря вставляет данные программы передач канала
+func renderPlaylist(playlist *m3u.Playlist, data map[string][]progr, set *settings, logf logFunc) *m3u.Playlist {
+	var nodes []m3u.Node
+	clearOwnedAttrs(playlist.Nodes) // атрибуты catchup каналов, которые больше не выводятся, не должны остаться
+loop:
+	for i, node := range playlist.Nodes {
+		nodes = append(nodes, node) // обычные строки плейлиста. Не обрабатываются.
+		// строка-якорь начала данных определенного канала
+		text, ok := node.(*m3u.Text)
+		if !ok || !isAnchorBegin(text.Text) {
+			continue loop
+		}
+		a, _ := parseAnchor(text.Text) // ошибку с номером строки уже вывел checkLines
+		if a == nil {
+			continue loop
+		}
+		ch := a.channel // получить название канала
+		days := a.days
+		if days < 0 {
+			days = channelDays(ch, set)
+		}
+		list := a.apply(archiveProgr(data[ch], days, set, time.Now())) // только те передачи, запись которых можно посмотреть
+
+		// атрибуты catchup у записи канала
+		if set.archivemode == archiveModeCatchup || set.archivemode == archiveModeBoth {
+			annotateCatchup(playlist.Nodes, i, ch, list, set, data, logf)
+		}
+		if set.archivemode == archiveModeCatchup {
+			continue loop
+		}
+
+		flag := true
+		for _, vol := range list { // передачи заданного канала
+			url, err := streamURL(vol, set)
+			if err != nil {
+				logf("Ошибка при формировании ссылки на запись передачи. Канал = %s: %v\n", ch, err)
+				continue
+			}
+
+			serviceInf, err := extinfLine(vol, flag, set, a.extinf) // в первой строке обычно задается имя группы
+			if err != nil {
+				logf("Ошибка при формировании строки #EXTINF. Канал = %s: %v\n", ch, err)
+				continue
+			}
+			flag = false
 
-	doc, err := goquery.NewDocument(sourceURL)
+			// сформировать запись плейлиста: атрибуты и название из шаблона, продолжительность и ссылка
+			entry := m3u.ParseExtinf("#EXTINF:-1 " + serviceInf)
+			entry.Duration = float64(extinfDuration(vol))
+			entry.URL = url
+			nodes = append(nodes, entry)
+		}
+	}
+	return &m3u.Playlist{Header: playlist.Header, Nodes: nodes, CRLF: playlist.CRLF}
+}
+
+// streamURL формирует ссылку на запись передачи по шаблону канала
+func streamURL(p progr, set *settings) (string, error) {
+	tmpl := set.streamurl
+	if chs, ok := set.chset[p.channel]; ok && chs.streamurl != nil {
+		tmpl = chs.streamurl
+	}
+	if tmpl == nil {
+		tmpl = defStreamTmpl
+	}
+	return execTemplate(tmpl, newProgrData(p))
+}
+
+// annotateCatchup добавляет атрибуты catchup в запись канала. anchor - номер строки-якоря канала в nodes
+func annotateCatchup(nodes []m3u.Node, anchor int, ch string, list []progr, set *settings, data map[string][]progr, logf logFunc) {
+	if len(list) == 0 {
+		return
+	}
+	tmpl := set.catchupsrc
+	if tmpl == nil {
+		tmpl = defCatchupTmpl
+	}
+	source, err := execTemplate(tmpl, newProgrData(list[0]))
 	if err != nil {
-		log.Printf("Ошибка при получении html-страницы. URL = %s\n", url)
-		return nil, err
+		logf("Ошибка при формировании атрибута catchup-source. Канал = %s: %v\n", ch, err)
+		return
+	}
+	entry := liveEntryFor(nodes, anchor, ch, set, data)
+	if entry == nil {
+		logf("Канал %s: в плейлисте нет записи канала для атрибутов catchup (поиск по tvg-id, tvg-name и названию). Поставьте строку-якорь сразу после записи канала.\n", ch)
+		return
+	}
+	annotateLiveEntry(entry, source, catchupDays(list, time.Now()))
+
+	// {catchup-id} плеер берет из программы передач канала, найденной по tvg-id. В XMLTV-файле updplaylist id канала - его название
+	if !strings.Contains(source, "{catchup-id}") || set.xmltv == "" {
+		return
 	}
-	doc.Find("#cn-ru #master.cn-master #cnbody.cnbody #graycontainer #container.no-padding.scnt .tv-inner-content #mtvprg-program.prg-list ol li").Each(func(i int, s *goquery.Selection) {
-		s.Find(".tlcbar.is-able").Each(func(i int, s *goquery.Selection) {
-			strProgr := progr{}
-			timeBeginProgr := s.Find("ins").Text()
-			nameProgr := s.Find("dfn a").Text()
-
-			hrefDate, _ := s.Find("ins a").Attr("href")
-			splitStr := strings.Split(hrefDate, "/")
-			strDate := splitStr[len(splitStr)-2]
-			dateTime, _ := time.Parse("2006-01-02T15:04:05-0700", strDate)
-			yearPr, monthPr, dayPr := dateTime.Date()
-			datePr := time.Date(yearPr, monthPr, dayPr, 0, 0, 0, 0, dateTime.Location())
-
-			hrefProgr, _ := s.Find("dfn a").Attr("href")
-			splitStr = strings.Split(hrefProgr, "/")
-			id := splitStr[len(splitStr)-2]
-
-			//fmt.Println(s.Html())
-			//fmt.Println(timeBeginProgr)
-			strProgr.datepr = datePr
-			strProgr.timepr = dateTime
-			strProgr.timeBeginProgr = timeBeginProgr
-			strProgr.nameProgr = nameProgr
-			strProgr.hrefProgr = hrefProgr
-			strProgr.idProgr = id
-			listProgr = append(listProgr, strProgr)
-		})
-	})
-
-	return listProgr, nil
+	if id, _ := entry.Attrs.Get("tvg-id"); id == "" {
+		setOwnedAttr(entry, "tvg-id", ch)
+	} else if id != ch {
+		logf("Канал %s: tvg-id=%q записи канала не совпадает с id канала в XMLTV-файле (%s). Плеер не сможет подставить {catchup-id}.\n", ch, id, ch)
+	}
+}
+
+// extinfLine формирует по шаблону канала атрибуты и название записи передачи для строки #EXTINF.
+// tmpl - шаблон из строки-якоря. nil - шаблон из настроек канала
+func extinfLine(p progr, first bool, set *settings, tmpl *template.Template) (string, error) {
+	if tmpl == nil {
+		tmpl = set.extinf
+		if chs, ok := set.chset[p.channel]; ok && chs.extinf != nil {
+			tmpl = chs.extinf
+		}
+	}
+	if tmpl == nil {
+		tmpl = defExtinfTmpl
+	}
+	data := newProgrData(p)
+	data.First = first
+	line, err := execTemplate(tmpl, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(line, "\n", " ", -1), nil // перевод строки испортил бы плейлист
+}
+
+// recentDays оставляет дни программы передач не старше заданного количества дней. Будущие дни остаются
+func recentDays(list []listDay, days int, now time.Time) []listDay {
+	first := dayStart(now).AddDate(0, 0, -days)
+	var recent []listDay
+	for _, day := range list {
+		if !day.dataProgr.Before(first) {
+			recent = append(recent, day)
+		}
+	}
+	return recent
+}
+
+// sortProgr сортирует массив передач канала: дни программы передач по убыванию, передачи внутри дня по возрастанию времени
+func sortProgr(list []progr) {
+	dataProg := func(c1, c2 *progr) bool { // дни программы передач сортировать по убыванию (... 5, 4, 3, 2,..,)
+		return c1.dataProgr.After(c2.dataProgr)
+	}
+
+	datepr := func(c1, c2 *progr) bool { // дни внутри одного дня программы передач сортировать по возрастанию. Бывает, что в программе передач передачи заканчиваются ночью следующего дня
+		return c1.datepr.Before(c2.datepr)
+	}
+
+	timepr := func(c1, c2 *progr) bool { // время внутри одного дня программы передач сортировать возрастанию.
+		return c1.timepr.Before(c2.timepr)
+	}
+
+	orderBy(dataProg, datepr, timepr).Sort(list)
+}
+
+// channelDays возвращает глубину архива канала в днях. 0 - все дни
+func channelDays(ch string, set *settings) int {
+	if chs, ok := set.chset[ch]; ok {
+		return chs.days
+	}
+	return set.archivedays
+}
+
+// archiveProgr оставляет передачи канала, запись которых можно посмотреть: не старше days дней (0 - любые) и, если задано, уже закончившиеся
+func archiveProgr(list []progr, days int, set *settings, now time.Time) []progr {
+	first := dayStart(now).AddDate(0, 0, -days)
+
+	var res []progr
+	for _, vol := range list {
+		if days > 0 && vol.dataProgr.Before(first) {
+			continue // старше глубины архива
+		}
+		if set.airedonly && !aired(vol, now) {
+			continue // передача еще не закончилась
+		}
+		res = append(res, vol)
+	}
+	return res
+}
+
+// aired сообщает, закончилась ли передача. Передача с неизвестным временем окончания считается еще идущей
+func aired(p progr, now time.Time) bool {
+	return !p.timepr.After(now) && !p.endpr.IsZero() && !p.endpr.After(now)
+}
+
+// dayStart возвращает дату в том же виде, что и dataProgr дня программы передач: полночь по UTC
+func dayStart(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// setEndTimes рассчитывает время окончания передач. Передача заканчивается, когда на канале начинается следующая.
+// Время окончания, полученное от поставщика, не меняется. Если следующей передачи нет или она в одном из следующих
+// дней, программа которых не получена, продолжительность передачи считается равной fallback. 0 - окончание неизвестно
+func setEndTimes(list []progr, fallback time.Duration) {
+	sorted := make([]progr, len(list))
+	copy(sorted, list)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].timepr.Before(sorted[j].timepr) })
+
+	for i := range list {
+		if list[i].endpr.After(list[i].timepr) {
+			continue // окончание передачи известно от поставщика
+		}
+		list[i].endpr = time.Time{}
+		k := sort.Search(len(sorted), func(n int) bool { return sorted[n].timepr.After(list[i].timepr) })
+		if k < len(sorted) && !sorted[k].dataProgr.After(list[i].dataProgr.AddDate(0, 0, 1)) {
+			list[i].endpr = sorted[k].timepr
+		} else if fallback > 0 { // последняя передача дня, за которым нет программы передач
+			list[i].endpr = list[i].timepr.Add(fallback)
+		}
+	}
+}
+
+// duration возвращает продолжительность передачи. 0, если время окончания неизвестно
+func (p progr) duration() time.Duration {
+	if p.endpr.IsZero() {
+		return 0
+	}
+	return p.endpr.Sub(p.timepr)
+}
+
+// extinfDuration возвращает продолжительность записи в секундах для строки #EXTINF. -1, если неизвестна
+func extinfDuration(p progr) int {
+	if d := p.duration(); d > 0 {
+		return int(d / time.Second)
+	}
+	return -1
 }
 
 // readLines считывает из текстового файла в строковый массив
@@ -454,28 +779,77 @@ func readLines(path string) ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// logFunc выводит замечания к плейлисту. При записи плейлиста в файл замечания выводятся в журнал (log.Printf),
+// при отдаче по http - нет (quiet): плейлист формируется при каждом запросе, а замечания уже выведены при записи
+type logFunc func(format string, v ...interface{})
+
+// quiet не выводит замечания
+func quiet(string, ...interface{}) {}
+
 // checkLines удаляет из массив старые данные. Расставляет якорные строки.
-func checkLines(lines []string) ([]string, error) {
+// Строки-якоря с ошибками выводятся в лог с номером строки и остаются в плейлисте как обычные строки
+func checkLines(playlist *m3u.Playlist, set *settings, data map[string][]progr, logf logFunc) (*m3u.Playlist, error) {
 	var foundBegin bool
-	var newlines []string
+	var nodes []m3u.Node
 	var listch []string
 
-	for _, key := range cfstruct.channels {
+	for _, key := range set.channels {
 		listch = append(listch, key.Value())
 	}
 
+	var orphans []*m3u.Text // строки-якоря каналов, которых нет в секции channels
+	var endAction string    // что сделать со строкой-якорем конца блока: orphanRemove, orphanComment. Пустая строка - оставить
+	var restored bool       // строка-якорь начала блока раскомментирована. Строку-якорь конца тоже нужно раскомментировать
+
 loop_1:
-	for _, str := range lines {
-		if strings.HasPrefix(str, "#archive-end") {
-			foundBegin = false
-		}
-		if strings.HasPrefix(str, "#archive-begin") && !foundBegin {
-			strSplit := strings.Split(str, "-")
-			if len(strSplit) != 3 {
-				log.Printf("Ошибка в строке: %s. Правильный пример: #archive-begin-rossija\n", str)
+	for _, node := range playlist.Nodes {
+		text, ok := node.(*m3u.Text)
+		if ok && !foundBegin && isCommentedAnchor(text.Text) {
+			if t := restoreOrphan(text, set, logf); t != nil {
+				text, node, restored = t, t, true
+			} else {
+				orphans = append(orphans, text) // канала по-прежнему нет в настройках
+			}
+		}
+		if ok && foundBegin && restored && text.Text == orphanPrefix+anchorEnd {
+			text = &m3u.Text{Line: text.Line, Text: anchorEnd}
+			node = text
+		}
+		if ok && isAnchorEnd(text.Text) {
+			foundBegin, restored = false, false
+			action := endAction
+			endAction = ""
+			switch action {
+			case orphanRemove:
 				continue loop_1
+			case orphanComment:
+				node = &m3u.Text{Line: text.Line, Text: orphanPrefix + text.Text}
+			}
+		}
+		if ok && isAnchorBegin(text.Text) && !foundBegin {
+			a, err := parseAnchor(text.Text)
+			if a == nil {
+				logf("Ошибка в строке %d плейлиста: %s: %v\n", text.Line, text.Text, err)
+				nodes = append(nodes, node)
+				continue loop_1
+			}
+			if err != nil { // блок канала обновляется, неверные параметры не применяются
+				logf("Ошибка в строке %d плейлиста: %s: %v. Параметр не применяется\n", text.Line, text.Text, err)
+			}
+			channel := a.channel
+			if isOrphan(channel, set) {
+				orphans = append(orphans, text)
+				foundBegin = true
+				switch set.orphans {
+				case orphanRemove:
+					endAction = orphanRemove
+					continue loop_1
+				case orphanComment:
+					endAction = orphanComment
+					nodes = append(nodes, &m3u.Text{Line: text.Line, Text: orphanPrefix + text.Text})
+					continue loop_1
+				}
 			}
-			channel := strSplit[2]
 		loop:
 			for i, vol := range listch {
 				if vol == channel {
@@ -486,34 +860,56 @@ loop_1:
 					break loop
 				}
 			}
-			newlines = append(newlines, str)
+			nodes = append(nodes, node)
 			foundBegin = true
 		} else if !foundBegin {
-			newlines = append(newlines, str)
+			nodes = append(nodes, node)
 		}
 	}
 
-	// если в плейлисте нет строк-якорей для каналов, то создать их в конце файла
-	for _, vol := range listch {
-		newlines = append(newlines, "#archive-begin-"+vol)
-		newlines = append(newlines, "#archive-end")
-	}
-	return newlines, nil
+	reportOrphans(orphans, set, logf)
+
+	// если в плейлисте нет строк-якорей для каналов, то создать их после записи канала или в конце файла
+	nodes = placeAnchors(nodes, listch, set, data)
+	return &m3u.Playlist{Header: playlist.Header, Nodes: nodes, CRLF: playlist.CRLF}, nil
 }
 
-// writeLines записывает обработанный плейлист в файл
-func writeLines(lines []string, path string) error {
-	file, err := os.Create(path)
+// readPlaylist считывает и разбирает плейлист
+func readPlaylist(path string) (*m3u.Playlist, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
+	return m3u.Parse(file)
+}
 
-	w := bufio.NewWriter(file)
-	for _, line := range lines {
-		fmt.Fprintln(w, line)
+// loadPlaylist считывает плейлист. Если файла нет, плейлист создается из файла-заготовки playlisttemplate
+// или пустым, с одной строкой #EXTM3U. Строки-якоря для каналов добавит checkLines
+func loadPlaylist(set *settings, logf logFunc) (*m3u.Playlist, error) {
+	playlist, err := readPlaylist(set.pathplaylist)
+	if err == nil || !os.IsNotExist(err) {
+		return playlist, err
 	}
-	return w.Flush()
+
+	if set.pltemplate == "" {
+		logf("Плейлист %s не найден. Создается новый плейлист\n", set.pathplaylist)
+		return &m3u.Playlist{Header: &m3u.Header{}}, nil
+	}
+	logf("Плейлист %s не найден. Создается новый плейлист из заготовки %s\n", set.pathplaylist, set.pltemplate)
+	playlist, err = readPlaylist(set.pltemplate)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать заготовку плейлиста: %v", err)
+	}
+	if playlist.Header == nil {
+		playlist.Header = &m3u.Header{}
+	}
+	return playlist, nil
+}
+
+// writePlaylist записывает обработанный плейлист в файл. Прежние версии файла сохраняются в backups резервных копиях
+func writePlaylist(playlist *m3u.Playlist, path string, backups int) error {
+	return writeFileAtomic(path, backups, playlist.Write)
 }
 
 // сортировка массива структур по полям структуры
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+// testTime возвращает время в заданный день мая 2024 года
+func testTime(day, hour, minute int) time.Time {
+	return time.Date(2024, time.May, day, hour, minute, 0, 0, time.UTC)
+}
+
+// testProgr создает передачу дня программы day, начинающуюся в заданное время дня startDay. Окончание неизвестно
+func testProgr(day, startDay, hour, minute int) progr {
+	return progr{dataProgr: testTime(day, 0, 0), timepr: testTime(startDay, hour, minute)}
+}
+
+func TestSetEndTimes(t *testing.T) {
+	withEnd := testProgr(1, 1, 10, 0)
+	withEnd.endpr = testTime(1, 10, 45)
+
+	tests := []struct {
+		name     string
+		list     []progr
+		fallback time.Duration
+		want     []time.Time // ожидаемое время окончания. Нулевое - неизвестно
+	}{
+		{name: "next in the same day", fallback: time.Hour,
+			list: []progr{testProgr(1, 1, 10, 0), testProgr(1, 1, 11, 30)},
+			want: []time.Time{testTime(1, 11, 30), testTime(1, 12, 30)}},
+		{name: "unsorted", fallback: time.Hour,
+			list: []progr{testProgr(1, 1, 12, 0), testProgr(1, 1, 9, 0), testProgr(1, 1, 10, 15)},
+			want: []time.Time{testTime(1, 13, 0), testTime(1, 10, 15), testTime(1, 12, 0)}},
+		{name: "across midnight", fallback: time.Hour,
+			list: []progr{testProgr(1, 1, 23, 30), testProgr(1, 2, 0, 40), testProgr(2, 2, 6, 0)},
+			want: []time.Time{testTime(2, 0, 40), testTime(2, 6, 0), testTime(2, 7, 0)}},
+		{name: "next day missing", fallback: 90 * time.Minute,
+			list: []progr{testProgr(1, 1, 23, 0), testProgr(3, 3, 6, 0)},
+			want: []time.Time{testTime(2, 0, 30), testTime(3, 7, 30)}},
+		{name: "no fallback",
+			list: []progr{testProgr(1, 1, 10, 0), testProgr(1, 1, 11, 0)},
+			want: []time.Time{testTime(1, 11, 0), {}}},
+		{name: "provider end kept", fallback: time.Hour,
+			list: []progr{withEnd, testProgr(1, 1, 11, 0)},
+			want: []time.Time{testTime(1, 10, 45), testTime(1, 12, 0)}},
+		{name: "provider end before start", fallback: time.Hour,
+			list: []progr{{dataProgr: testTime(1, 0, 0), timepr: testTime(1, 10, 0), endpr: testTime(1, 9, 0)}, testProgr(1, 1, 11, 0)},
+			want: []time.Time{testTime(1, 11, 0), testTime(1, 12, 0)}},
+	}
+	for _, tt := range tests {
+		setEndTimes(tt.list, tt.fallback)
+		for i, p := range tt.list {
+			if !p.endpr.Equal(tt.want[i]) {
+				t.Errorf("%s: передача %d (%s) заканчивается в %s, ожидается %s", tt.name, i, p.timepr.Format("02 15:04"), p.endpr, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestArchiveProgr(t *testing.T) {
+	now := testTime(10, 12, 0)
+	ended := func(p progr, end time.Time) progr { p.endpr = end; return p }
+	list := []progr{
+		ended(testProgr(2, 2, 10, 0), testTime(2, 11, 0)),      // 0: старше глубины архива
+		ended(testProgr(3, 3, 10, 0), testTime(3, 11, 0)),      // 1: первый день архива
+		ended(testProgr(10, 10, 10, 0), testTime(10, 11, 0)),   // 2: закончилась
+		ended(testProgr(10, 10, 11, 30), testTime(10, 12, 0)),  // 3: заканчивается сейчас
+		ended(testProgr(10, 10, 11, 45), testTime(10, 12, 30)), // 4: идет
+		testProgr(10, 10, 11, 50),                              // 5: окончание неизвестно
+		ended(testProgr(11, 11, 10, 0), testTime(11, 11, 0)),   // 6: завтра
+	}
+	tests := []struct {
+		name      string
+		days      int
+		airedonly bool
+		want      []int // номера оставшихся передач
+	}{
+		{name: "all", days: 0, want: []int{0, 1, 2, 3, 4, 5, 6}},
+		{name: "days", days: 7, want: []int{1, 2, 3, 4, 5, 6}},
+		{name: "aired only", days: 7, airedonly: true, want: []int{1, 2, 3}},
+		{name: "aired only all days", days: 0, airedonly: true, want: []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		set := testSettings()
+		set.airedonly = tt.airedonly
+		got := archiveProgr(list, tt.days, set, now)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: передач %d, ожидается %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, n := range tt.want {
+			if !got[i].timepr.Equal(list[n].timepr) {
+				t.Errorf("%s: передача %d начинается в %s, ожидается %s", tt.name, i, got[i].timepr, list[n].timepr)
+			}
+		}
+	}
+}
+
+func TestRecentDays(t *testing.T) {
+	now := testTime(10, 23, 59)
+	var list []listDay
+	for _, day := range []int{11, 10, 4, 3, 2} {
+		list = append(list, listDay{dataProgr: testTime(day, 0, 0)})
+	}
+	tests := []struct {
+		days int
+		want int // дней в ответе
+	}{
+		{0, 2},
+		{1, 2},
+		{6, 3},
+		{7, 4},
+		{30, 5},
+	}
+	for _, tt := range tests {
+		got := recentDays(list, tt.days, now)
+		if len(got) != tt.want {
+			t.Errorf("days = %d: дней %d, ожидается %d", tt.days, len(got), tt.want)
+			continue
+		}
+		if len(got) > 0 && !got[0].dataProgr.Equal(list[0].dataProgr) {
+			t.Errorf("days = %d: будущий день программы передач удален", tt.days)
+		}
+	}
+}
+
+// testCheckLines разбирает плейлист, проверяет строки-якоря и возвращает записанный результат
+func testCheckLines(t *testing.T, in string, set *settings) string {
+	playlist, err := m3u.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, err = checkLines(playlist, set, nil, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := playlist.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestCheckLines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "missing anchors",
+			in:   "#EXTM3U\n#EXTINF:-1,НТВ\nhttp://a/1\n",
+			want: "#EXTM3U\n#EXTINF:-1,НТВ\nhttp://a/1\n#archive-begin-ch1\n#archive-end\n#archive-begin-ch2\n#archive-end\n"},
+		{name: "old block removed",
+			in:   "#EXTM3U\n#archive-begin-ch1 days=3\n#EXTINF:60,Старая\nhttp://a/old\n#archive-end\n#archive-begin-ch2\n#archive-end\n",
+			want: "#EXTM3U\n#archive-begin-ch1 days=3\n#archive-end\n#archive-begin-ch2\n#archive-end\n"},
+		{name: "bad options",
+			in:   "#EXTM3U\n#archive-begin-ch1 days=abc\n#EXTINF:60,Старая\nhttp://a/old\n#archive-end\n#archive-begin-ch2\n#archive-end\n",
+			want: "#EXTM3U\n#archive-begin-ch1 days=abc\n#archive-end\n#archive-begin-ch2\n#archive-end\n"},
+		{name: "no channel",
+			in:   "#EXTM3U\n#archive-begin-\n#archive-end\n#archive-begin-ch1\n#archive-end\n",
+			want: "#EXTM3U\n#archive-begin-\n#archive-end\n#archive-begin-ch1\n#archive-end\n#archive-begin-ch2\n#archive-end\n"},
+	}
+	for _, tt := range tests {
+		if got := testCheckLines(t, tt.in, testSettings("ch1", "ch2")); got != tt.want {
+			t.Errorf("%s: записано:\n%q\nожидается:\n%q", tt.name, got, tt.want)
+		}
+	}
+}
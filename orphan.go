@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+// что делать со строками-якорями каналов, которых нет в секции channels
+const (
+	orphanKeep    = "keep"    // оставить. Блок канала остается пустым
+	orphanRemove  = "remove"  // удалить строку-якорь начала и строку-якорь конца
+	orphanComment = "comment" // закомментировать обе строки. Если канал снова появится в настройках, строки будут раскомментированы
+)
+
+const orphanPrefix = "#orphan " // начало закомментированной строки-якоря
+
+// isOrphan сообщает, что канала строки-якоря нет в секции channels. Отключенные каналы (enabled = false) не считаются
+func isOrphan(channel string, set *settings) bool {
+	_, ok := set.chset[channel]
+	return !ok
+}
+
+// orphanAction возвращает, что будет сделано со строкой-якорем канала, которого нет в настройках
+func orphanAction(policy string) string {
+	switch policy {
+	case orphanRemove:
+		return "удалена"
+	case orphanComment:
+		return "закомментирована"
+	}
+	return "оставлена"
+}
+
+// isCommentedAnchor сообщает, что строка плейлиста - закомментированная строка-якорь начала
+func isCommentedAnchor(str string) bool {
+	return strings.HasPrefix(str, orphanPrefix+anchorBegin)
+}
+
+// reportOrphans выводит список строк-якорей каналов, которых нет в секции channels, в том числе закомментированных ранее
+func reportOrphans(orphans []*m3u.Text, set *settings, logf logFunc) {
+	if len(orphans) == 0 {
+		return
+	}
+	var list []string
+	for _, text := range orphans {
+		action := orphanAction(set.orphans)
+		if isCommentedAnchor(text.Text) {
+			action = "закомментирована ранее. Удалите ее вместе с " + orphanPrefix + anchorEnd + ", если канал больше не нужен"
+		}
+		if a, _ := parseAnchor(strings.TrimPrefix(text.Text, orphanPrefix)); a != nil {
+			list = append(list, a.channel)
+		}
+		logf("Строка %d плейлиста: %s: канала нет в секции channels. Строка-якорь %s\n", text.Line, text.Text, action)
+	}
+	logf("Строк-якорей каналов, которых нет в настройках: %d (%s)\n", len(list), strings.Join(list, ", "))
+}
+
+// restoreOrphan раскомментирует строку-якорь начала, закомментированную при orphananchors = comment,
+// если ее канал снова есть в секции channels. Иначе возвращает nil
+func restoreOrphan(text *m3u.Text, set *settings, logf logFunc) *m3u.Text {
+	str := strings.TrimPrefix(text.Text, orphanPrefix)
+	a, _ := parseAnchor(str)
+	if a == nil || isOrphan(a.channel, set) {
+		return nil
+	}
+	logf("Строка %d плейлиста: канал %s снова есть в настройках. Строка-якорь раскомментирована\n", text.Line, a.channel)
+	return &m3u.Text{Line: text.Line, Text: str}
+}
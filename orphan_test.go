@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestOrphanAnchors(t *testing.T) {
+	const (
+		block     = "#archive-begin-x\n#EXTINF:60,Старая\nhttp://a/old\n#archive-end\n"
+		commented = "#orphan #archive-begin-x days=3\n#orphan #archive-end\n"
+		ch1       = "#archive-begin-ch1\n#archive-end\n"
+	)
+	tests := []struct {
+		name     string
+		channels []string
+		disabled string // последний канал списка отключен (enabled = false)
+		in       string
+		want     map[string]string // политика orphananchors -> ожидаемый плейлист
+	}{
+		{name: "orphan block", channels: []string{"ch1"},
+			in: "#EXTM3U\n" + block + ch1,
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n#archive-begin-x\n#archive-end\n" + ch1,
+				orphanRemove:  "#EXTM3U\n" + ch1,
+				orphanComment: "#EXTM3U\n#orphan #archive-begin-x\n#orphan #archive-end\n" + ch1,
+			}},
+		{name: "commented, channel still missing", channels: []string{"ch1"},
+			in: "#EXTM3U\n" + commented + ch1,
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n" + commented + ch1,
+				orphanRemove:  "#EXTM3U\n" + commented + ch1,
+				orphanComment: "#EXTM3U\n" + commented + ch1,
+			}},
+		{name: "commented, channel configured again", channels: []string{"ch1", "x"},
+			in: "#EXTM3U\n" + commented + ch1,
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n#archive-begin-x days=3\n#archive-end\n" + ch1,
+				orphanRemove:  "#EXTM3U\n#archive-begin-x days=3\n#archive-end\n" + ch1,
+				orphanComment: "#EXTM3U\n#archive-begin-x days=3\n#archive-end\n" + ch1,
+			}},
+		{name: "disabled channel is not orphan", channels: []string{"ch1", "x"}, disabled: "x",
+			in: "#EXTM3U\n" + block + ch1,
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n#archive-begin-x\n#archive-end\n" + ch1,
+				orphanRemove:  "#EXTM3U\n#archive-begin-x\n#archive-end\n" + ch1,
+				orphanComment: "#EXTM3U\n#archive-begin-x\n#archive-end\n" + ch1,
+			}},
+		{name: "unterminated orphan block", channels: []string{"ch1"},
+			in: "#EXTM3U\n#EXTINF:-1,Канал\nhttp://a/1\n#archive-begin-x\n#EXTINF:60,Старая\nhttp://a/old\n",
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n#EXTINF:-1,Канал\nhttp://a/1\n#archive-begin-x\n" + ch1,
+				orphanRemove:  "#EXTM3U\n#EXTINF:-1,Канал\nhttp://a/1\n" + ch1,
+				orphanComment: "#EXTM3U\n#EXTINF:-1,Канал\nhttp://a/1\n#orphan #archive-begin-x\n" + ch1,
+			}},
+		{name: "unterminated commented block", channels: []string{"ch1"},
+			in: "#EXTM3U\n#orphan #archive-begin-x\n#EXTINF:-1,Канал\nhttp://a/1\n" + ch1,
+			want: map[string]string{
+				orphanKeep:    "#EXTM3U\n#orphan #archive-begin-x\n#EXTINF:-1,Канал\nhttp://a/1\n" + ch1,
+				orphanRemove:  "#EXTM3U\n#orphan #archive-begin-x\n#EXTINF:-1,Канал\nhttp://a/1\n" + ch1,
+				orphanComment: "#EXTM3U\n#orphan #archive-begin-x\n#EXTINF:-1,Канал\nhttp://a/1\n" + ch1,
+			}},
+	}
+	for _, tt := range tests {
+		for policy, want := range tt.want {
+			set := testSettings(tt.channels...)
+			set.orphans = policy
+			if tt.disabled != "" { // отключенного канала нет в set.channels, но он есть в set.chset
+				set = testSettings(tt.channels[:len(tt.channels)-1]...)
+				set.orphans = policy
+				set.chset[tt.disabled] = &channelSettings{enabled: false}
+			}
+			if got := testCheckLines(t, tt.in, set); got != want {
+				t.Errorf("%s, %s: записано:\n%q\nожидается:\n%q", tt.name, policy, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+// куда ставить строки-якоря новых каналов
+const (
+	anchorPlaceEnd   = "end"   // в конец плейлиста
+	anchorPlaceEntry = "entry" // сразу после записи канала с прямой трансляцией. Если запись не найдена - в конец
+)
+
+const fuzzyMinSimilarity = 0.8 // минимальное сходство названий при нечетком сравнении: 1 - совпадают, 0 - ничего общего
+
+// слова, которые не учитываются при сравнении названий каналов
+var nameNoise = map[string]bool{"hd": true, "fhd": true, "uhd": true, "sd": true, "4k": true}
+
+// placeAnchors добавляет строки-якоря каналов, у которых их нет. При anchorplace = entry блок канала ставится
+// сразу после найденной записи канала с прямой трансляцией, остальные блоки - в конец плейлиста
+func placeAnchors(nodes []m3u.Node, missing []string, set *settings, data map[string][]progr) []m3u.Node {
+	after := make(map[int][]string) // номер элемента плейлиста -> каналы, блоки которых ставятся после него
+	var unmatched []string
+	for _, ch := range missing {
+		i := -1
+		if set.anchorplace == anchorPlaceEntry {
+			i = findLiveEntry(nodes, ch, set, data)
+		}
+		if i < 0 {
+			unmatched = append(unmatched, ch)
+			continue
+		}
+		after[i] = append(after[i], ch)
+	}
+
+	var res []m3u.Node
+	for i, node := range nodes {
+		res = append(res, node)
+		for _, ch := range after[i] {
+			res = append(res, &m3u.Text{Text: anchorBegin + ch}, &m3u.Text{Text: anchorEnd})
+		}
+	}
+	for _, ch := range unmatched {
+		res = append(res, &m3u.Text{Text: anchorBegin + ch}, &m3u.Text{Text: anchorEnd})
+	}
+	return res
+}
+
+// уровни совпадения записи плейлиста с каналом, по убыванию надежности
+const (
+	matchNone  = iota // не совпадает
+	matchTitle        // похожее название записи
+	matchName         // атрибут tvg-name
+	matchID           // атрибут tvg-id
+)
+
+// liveMatcher сравнивает записи плейлиста с каналом: по атрибуту tvg-id (название канала или xmltvid),
+// по tvg-name и по похожему названию записи
+type liveMatcher struct {
+	ids   []string
+	names []string // названия канала, приведенные normalizeName
+}
+
+// newLiveMatcher собирает идентификаторы и названия канала из настроек и программы передач
+func newLiveMatcher(ch string, set *settings, data map[string][]progr) *liveMatcher {
+	m := &liveMatcher{ids: []string{ch}}
+	if chs, ok := set.chset[ch]; ok {
+		if chs.xmltvid != "" {
+			m.ids = append(m.ids, chs.xmltvid)
+		}
+		if name := normalizeName(chs.name); name != "" {
+			m.names = append(m.names, name)
+		}
+	}
+	if list := data[ch]; len(list) > 0 {
+		if name := normalizeName(list[0].nameChannel); name != "" { // название канала с сайта
+			m.names = append(m.names, name)
+		}
+	}
+	return m
+}
+
+// match возвращает уровень совпадения записи с каналом и сходство названий (1 для tvg-id и tvg-name)
+func (m *liveMatcher) match(entry *m3u.Entry) (int, float64) {
+	if !entry.Info || entry.URL == "" { // запись канала с прямой трансляцией - со строкой #EXTINF и ссылкой
+		return matchNone, 0
+	}
+	if id, ok := entry.Attrs.Get("tvg-id"); ok {
+		for _, want := range m.ids {
+			if strings.EqualFold(id, want) {
+				return matchID, 1
+			}
+		}
+	}
+	if name, ok := entry.Attrs.Get("tvg-name"); ok {
+		for _, want := range m.names {
+			if normalizeName(name) == want {
+				return matchName, 1
+			}
+		}
+	}
+	best := 0.0
+	if title := normalizeName(entry.Title); title != "" {
+		for _, want := range m.names {
+			if digits(title) != digits(want) {
+				continue // "Россия 1" и "Россия 24", "ТВ3" и "ТВЦ" - разные каналы, хотя названия похожи
+			}
+			if score := similarity(title, want); score > best {
+				best = score
+			}
+		}
+	}
+	if best < fuzzyMinSimilarity {
+		return matchNone, 0
+	}
+	return matchTitle, best
+}
+
+// findLiveEntry ищет запись канала с прямой трансляцией: сначала по атрибуту tvg-id (название канала или xmltvid),
+// затем по tvg-name, затем по похожему названию записи. Возвращает номер элемента плейлиста или -1
+func findLiveEntry(nodes []m3u.Node, ch string, set *settings, data map[string][]progr) int {
+	m := newLiveMatcher(ch, set, data)
+	best, bestLevel, bestScore := -1, matchNone, 0.0
+	for i, node := range nodes {
+		entry, ok := node.(*m3u.Entry)
+		if !ok {
+			continue
+		}
+		if level, score := m.match(entry); level > bestLevel || (level == bestLevel && score > bestScore) {
+			best, bestLevel, bestScore = i, level, score
+		}
+	}
+	return best
+}
+
+// normalizeName приводит название канала к виду для сравнения: строчные буквы и цифры без пробелов и знаков,
+// ё заменяется на е, слова hd, sd и т.п. отбрасываются
+func normalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var b strings.Builder
+	for _, word := range words {
+		if nameNoise[word] {
+			continue
+		}
+		b.WriteString(strings.Replace(word, "ё", "е", -1))
+	}
+	return b.String()
+}
+
+// digits возвращает цифры строки. Номер в названии отличает один канал от другого
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// similarity возвращает сходство строк: 1 минус расстояние Левенштейна, деленное на длину более длинной строки
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein возвращает расстояние Левенштейна: наименьшее количество вставок, удалений и замен символов
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1 // удаление
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1 // вставка
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost // замена
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
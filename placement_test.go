@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Первый канал", "первыйканал"},
+		{"Первый канал HD", "первыйканал"},
+		{"  Россия-1 (SD) ", "россия1"},
+		{"Пятница!", "пятница"},
+		{"Ёлки FHD", "елки"},
+		{"ТВ3", "тв3"},
+		{"HD", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("%q: %q, ожидается %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"нтв", "нтв", 1},
+		{"нтв", "", 0},
+		{"тв3", "твц", 1 - 1.0/3},
+		{"россия1", "россия24", 1 - 2.0/8},
+		{"первыйканал", "первыйкaнал", 1 - 1.0/11}, // латинская a
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q, %q: %v, ожидается %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// testNodes разбирает записи плейлиста
+func testNodes(t *testing.T, in string) []m3u.Node {
+	p, err := m3u.Parse(strings.NewReader("#EXTM3U\n" + in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Nodes
+}
+
+func TestFindLiveEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		chname  string // название канала в настройках
+		xmltvid string
+		in      string
+		want    int // номер элемента плейлиста. -1 - не найден
+	}{
+		{name: "title", chname: "Первый канал",
+			in: "#EXTINF:-1,Первый канал HD\nhttp://a/1\n", want: 0},
+		{name: "close title with typo", chname: "Первый канал",
+			in: "#EXTINF:-1,Перввый канал\nhttp://a/1\n", want: 0},
+		{name: "other number", chname: "Россия 1",
+			in: "#EXTINF:-1,Россия 24\nhttp://a/1\n#EXTINF:-1,Россия К\nhttp://a/2\n", want: -1},
+		{name: "number among close titles", chname: "Россия 1",
+			in: "#EXTINF:-1,Россия 24\nhttp://a/1\n#EXTINF:-1,Россия-1 HD\nhttp://a/2\n", want: 1},
+		{name: "digit and letter", chname: "ТВ3",
+			in: "#EXTINF:-1,ТВЦ\nhttp://a/1\n", want: -1},
+		{name: "no url", chname: "Первый канал",
+			in: "#EXTINF:-1,Первый канал\n#EXTINF:-1,Второй\nhttp://a/2\n", want: -1},
+		{name: "tvg-name before title", chname: "Первый канал",
+			in: "#EXTINF:-1,Первый канал\nhttp://a/1\n#EXTINF:-1 tvg-name=\"Первый канал\",1TV\nhttp://a/2\n", want: 1},
+		{name: "tvg-id before tvg-name", chname: "Первый канал", xmltvid: "1tv.ru",
+			in: "#EXTINF:-1 tvg-name=\"Первый канал\",Первый\nhttp://a/1\n#EXTINF:-1 tvg-id=\"1TV.ru\",1TV\nhttp://a/2\n", want: 1},
+		{name: "tvg-id is channel", chname: "Первый канал",
+			in: "#EXTINF:-1 tvg-name=\"Первый канал\",Первый\nhttp://a/1\n#EXTINF:-1 tvg-id=\"ch\",1TV\nhttp://a/2\n", want: 1},
+		{name: "closest title", chname: "Первый канал",
+			in: "#EXTINF:-1,Перввый канал\nhttp://a/1\n#EXTINF:-1,Первый канал\nhttp://a/2\n", want: 1},
+		{name: "tie goes to first", chname: "Первый канал",
+			in: "#EXTINF:-1,Первый канал HD\nhttp://a/1\n#EXTINF:-1,Первый канал\nhttp://a/2\n", want: 0},
+		{name: "tie on tvg-id goes to first", chname: "Первый канал",
+			in: "#EXTINF:-1 tvg-id=\"ch\",A\nhttp://a/1\n#EXTINF:-1 tvg-id=\"CH\",B\nhttp://a/2\n", want: 0},
+	}
+	for _, tt := range tests {
+		set := testSettings("ch")
+		set.chset["ch"].name = tt.chname
+		set.chset["ch"].xmltvid = tt.xmltvid
+		if got := findLiveEntry(testNodes(t, tt.in), "ch", set, nil); got != tt.want {
+			t.Errorf("%s: найден элемент %d, ожидается %d", tt.name, got, tt.want)
+		}
+	}
+}
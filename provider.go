@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// provider источник программы передач.
+// Для канала возвращает список дней программы, для каждого дня - список передач.
+// При отмене ctx методы должны как можно быстрее вернуть ошибку.
+type provider interface {
+	// listDays получает для канала список дней программы передач (включая ссылку на страницу дня)
+	listDays(ctx context.Context, channel string) ([]listDay, error)
+	// listProgr получает список передач за один день
+	listProgr(ctx context.Context, day listDay) ([]progr, error)
+}
+
+const defProvider = "cnru" // поставщик программы передач по умолчанию
+
+// зарегистрированные поставщики программы передач. Ключ - имя поставщика в ini-файле
+var providers = map[string]provider{
+	"cnru":  cnruProvider{},
+	"xmltv": xmltvProvider{},
+}
+
+// getProvider возвращает поставщика программы передач по имени
+func getProvider(name string) (provider, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("неизвестный поставщик программы передач %q. Допустимые значения: %s", name, providerNames())
+	}
+	return p, nil
+}
+
+// providerNames возвращает через запятую имена всех зарегистрированных поставщиков
+func providerNames() string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/go-ini/ini"
+)
+
+// rebuildRequest запрос на внеочередное обновление плейлиста.
+// Если не задано ни full, ни channels, плейлист формируется заново из ранее собранных данных
+type rebuildRequest struct {
+	full     bool     // заново получить программу передач всех каналов
+	channels []string // заново получить программу передач только этих каналов
+}
+
+// канал запросов на внеочередное обновление плейлиста. Запросы выполняет updProgr
+var rebuild = make(chan rebuildRequest, 1)
+
+// merge объединяет два запроса в один
+func (r rebuildRequest) merge(other rebuildRequest) rebuildRequest {
+	merged := rebuildRequest{full: r.full || other.full}
+	if merged.full {
+		return merged
+	}
+	seen := make(map[string]bool)
+	for _, list := range [][]string{r.channels, other.channels} {
+		for _, ch := range list {
+			if !seen[ch] {
+				seen[ch] = true
+				merged.channels = append(merged.channels, ch)
+			}
+		}
+	}
+	sort.Strings(merged.channels)
+	return merged
+}
+
+// requestRebuild передает запрос горутине updProgr. Если предыдущий запрос еще не выполнен, запросы объединяются
+func requestRebuild(req rebuildRequest) {
+	for {
+		select {
+		case rebuild <- req:
+			return
+		case pending := <-rebuild:
+			req = req.merge(pending)
+		}
+	}
+}
+
+// diffSettings сравнивает настройки до и после перечитывания и определяет, какое обновление плейлиста нужно.
+// Для новых каналов и каналов со сменившимся поставщиком программа передач запрашивается заново,
+// при изменении остальных настроек вывода плейлист формируется из имеющихся данных
+func diffSettings(old, cur *settings) (rebuildRequest, bool) {
+	var req rebuildRequest
+	changed := false
+
+	oldChannels := channelSet(old.channels)
+	for _, key := range cur.channels {
+		ch := key.Value()
+		if !oldChannels[ch] {
+			req.channels = append(req.channels, ch) // канал добавлен
+			continue
+		}
+		o, c := old.chset[ch], cur.chset[ch]
+		if o == nil || c == nil {
+			continue
+		}
+		if o.provider != c.provider || o.xmltvid != c.xmltvid || o.name != c.name || o.group != c.group || o.days != c.days || o.retention != c.retention ||
+			(c.provider == "xmltv" && old.xmltvsource != cur.xmltvsource) {
+			req.channels = append(req.channels, ch) // программу передач нужно получить из другого источника
+			continue
+		}
+		if tmplText(o.streamurl) != tmplText(c.streamurl) || tmplText(o.extinf) != tmplText(c.extinf) {
+			changed = true
+		}
+	}
+
+	curChannels := channelSet(cur.channels)
+	for ch := range oldChannels {
+		if !curChannels[ch] {
+			changed = true // канал удален
+		}
+	}
+
+	if old.pathplaylist != cur.pathplaylist || old.archivemode != cur.archivemode || old.airedonly != cur.airedonly ||
+		old.orphans != cur.orphans ||
+		tmplText(old.catchupsrc) != tmplText(cur.catchupsrc) ||
+		old.xmltv != cur.xmltv || old.xmltvgzip != cur.xmltvgzip {
+		changed = true
+	}
+
+	if old.lastduration != cur.lastduration || old.details != cur.details || old.store != cur.store { // рассчитываются и запрашиваются при получении программы передач
+		log.Println("Изменились настройки получения программы передач. Программа передач будет получена заново")
+		return rebuildRequest{full: true}, true
+	}
+
+	sort.Strings(req.channels)
+	if len(req.channels) > 0 {
+		log.Println("Изменились настройки каналов:", strings.Join(req.channels, ", "))
+	}
+	return req, changed || len(req.channels) > 0
+}
+
+// channelSet возвращает множество названий каналов
+func channelSet(keys []*ini.Key) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range keys {
+		set[key.Value()] = true
+	}
+	return set
+}
+
+// filterChannels оставляет из списка каналов только заданные
+func filterChannels(keys []*ini.Key, only []string) []*ini.Key {
+	wanted := make(map[string]bool)
+	for _, ch := range only {
+		wanted[ch] = true
+	}
+	var list []*ini.Key
+	for _, key := range keys {
+		if wanted[key.Value()] {
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// pruneData оставляет в данных программы передач только каналы из настроек
+func pruneData(data map[string][]progr, keys []*ini.Key) map[string][]progr {
+	channels := channelSet(keys)
+	pruned := make(map[string][]progr)
+	for ch, vol := range data {
+		if channels[ch] {
+			pruned[ch] = vol
+		}
+	}
+	return pruned
+}
+
+// tmplText возвращает текст шаблона для сравнения
+func tmplText(tmpl *template.Template) string {
+	if tmpl == nil || tmpl.Tree == nil {
+		return ""
+	}
+	return tmpl.Tree.Root.String()
+}
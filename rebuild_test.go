@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"text/template"
+
+	"github.com/go-ini/ini"
+)
+
+// testSettings создает настройки с заданными каналами поставщика cnru
+func testSettings(channels ...string) *settings {
+	section, _ := ini.Empty().NewSection("channels")
+	set := &settings{
+		archivemode:  archiveModePrograms,
+		lastduration: 60,
+		chset:        make(map[string]*channelSettings),
+	}
+	for i, ch := range channels {
+		key, _ := section.NewKey(strconv.Itoa(i), ch)
+		set.channels = append(set.channels, key)
+		set.chset[ch] = &channelSettings{provider: "cnru", days: 7, enabled: true}
+	}
+	return set
+}
+
+func TestDiffSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels []string        // каналы новых настроек. nil - как в прежних
+		change   func(*settings) // изменение новых настроек
+		want     rebuildRequest  // ожидаемый запрос
+		rebuild  bool            // нужно ли обновление
+	}{
+		{name: "no changes", change: func(*settings) {}},
+		{name: "reload interval", change: func(s *settings) { s.updsetdelay = 5 }},
+		{name: "channel added", channels: []string{"ntv", "rossija", "sts"}, change: func(*settings) {},
+			want: rebuildRequest{channels: []string{"sts"}}, rebuild: true},
+		{name: "channel removed", channels: []string{"ntv"}, change: func(*settings) {}, rebuild: true},
+		{name: "provider", change: func(s *settings) { s.chset["rossija"].provider = "xmltv" },
+			want: rebuildRequest{channels: []string{"rossija"}}, rebuild: true},
+		{name: "days and group", change: func(s *settings) { s.chset["ntv"].days = 3; s.chset["rossija"].group = "Архив" },
+			want: rebuildRequest{channels: []string{"ntv", "rossija"}}, rebuild: true},
+		{name: "retention", change: func(s *settings) { s.chset["ntv"].retention = 10 },
+			want: rebuildRequest{channels: []string{"ntv"}}, rebuild: true},
+		{name: "xmltv source without xmltv channels", change: func(s *settings) { s.xmltvsource = "epg.xml" }},
+		{name: "xmltv source", change: func(s *settings) { s.chset["ntv"].provider = "xmltv"; s.xmltvsource = "epg.xml" },
+			want: rebuildRequest{channels: []string{"ntv"}}, rebuild: true},
+		{name: "channel template", change: func(s *settings) { s.chset["ntv"].extinf = template.Must(parseTemplate("extinf", ",{{.Name}}")) },
+			rebuild: true},
+		{name: "archive mode", change: func(s *settings) { s.archivemode = archiveModeCatchup }, rebuild: true},
+		{name: "aired only", change: func(s *settings) { s.airedonly = true }, rebuild: true},
+		{name: "orphan anchors", change: func(s *settings) { s.orphans = orphanRemove }, rebuild: true},
+		{name: "xmltv file", change: func(s *settings) { s.xmltv = "epg.xml" }, rebuild: true},
+		{name: "last duration", change: func(s *settings) { s.lastduration = 30 }, want: rebuildRequest{full: true}, rebuild: true},
+		{name: "details", change: func(s *settings) { s.details = true }, want: rebuildRequest{full: true}, rebuild: true},
+		{name: "store", channels: []string{"ntv", "rossija", "sts"}, change: func(s *settings) { s.store = "new.db" },
+			want: rebuildRequest{full: true}, rebuild: true},
+	}
+	for _, tt := range tests {
+		channels := tt.channels
+		if channels == nil {
+			channels = []string{"ntv", "rossija"}
+		}
+		old, cur := testSettings("ntv", "rossija"), testSettings(channels...)
+		tt.change(cur)
+		req, rebuild := diffSettings(old, cur)
+		if rebuild != tt.rebuild || !reflect.DeepEqual(req, tt.want) {
+			t.Errorf("%s: запрос %+v, обновление %v; ожидается %+v, %v", tt.name, req, rebuild, tt.want, tt.rebuild)
+		}
+	}
+}
+
+func TestRebuildRequestMerge(t *testing.T) {
+	tests := []struct {
+		a, b, want rebuildRequest
+	}{
+		{rebuildRequest{}, rebuildRequest{}, rebuildRequest{}},
+		{rebuildRequest{channels: []string{"sts", "ntv"}}, rebuildRequest{channels: []string{"ntv", "rossija"}},
+			rebuildRequest{channels: []string{"ntv", "rossija", "sts"}}},
+		{rebuildRequest{channels: []string{"ntv"}}, rebuildRequest{full: true}, rebuildRequest{full: true}},
+	}
+	for _, tt := range tests {
+		if got := tt.a.merge(tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v + %+v = %+v, ожидается %+v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
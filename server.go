@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newHTTPHandler возвращает обработчик http-сервера: плейлист по пути httppath, состояние программы и отладочные страницы pprof
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", http.DefaultServeMux) // обработчики pprof зарегистрированы в DefaultServeMux
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/", servePlaylist)
+	return mux
+}
+
+// publishSettings передает http-серверу копию текущих настроек. Вызывается при захваченном mutex
+func publishSettings() {
+	viewMutex.Lock()
+	viewSettings = cfstruct
+	viewMutex.Unlock()
+}
+
+// servePlaylist отдает плейлист, заполненный текущими данными программы передач.
+// Плейлист формируется при каждом запросе из файла pathplaylist. По ETag и Last-Modified клиент может не загружать плейлист повторно
+func servePlaylist(w http.ResponseWriter, r *http.Request) {
+	viewMutex.RLock()
+	set := viewSettings
+	data := chPr
+	updated := chPrUpdated
+	viewMutex.RUnlock()
+
+	if set.httppath == "" || r.URL.Path != set.httppath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	playlist, err := loadPlaylist(&set, quiet)
+	if err != nil {
+		log.Println("Ошибка при открытии и считывании плейлиста:", err)
+		http.Error(w, "playlist is not available", http.StatusServiceUnavailable)
+		return
+	}
+	playlist, err = checkLines(playlist, &set, data, quiet)
+	if err != nil {
+		log.Println("Ошибка при подготовке плейлиста:", err)
+		http.Error(w, "playlist is not available", http.StatusInternalServerError)
+		return
+	}
+	var body bytes.Buffer // плейлист записывается так же, как в файл: с BOM и переводами строк исходного плейлиста
+	if err = renderPlaylist(playlist, data, &set, quiet).Write(&body); err != nil {
+		log.Println("Ошибка при подготовке плейлиста:", err)
+		http.Error(w, "playlist is not available", http.StatusInternalServerError)
+		return
+	}
+
+	// плейлист изменяется при обновлении данных или при редактировании файла плейлиста
+	modtime := updated
+	if fi, err := os.Stat(set.pathplaylist); err == nil && fi.ModTime().After(modtime) {
+		modtime = fi.ModTime()
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(body.Bytes())))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(body.Bytes()))
+}
+
+// serveStatus отдает в формате JSON состояние программы: результат последнего перечитывания настроек и время обновления данных
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	viewMutex.RLock()
+	status := struct {
+		Config          configState `json:"config"`
+		PlaylistUpdated time.Time   `json:"playlist_updated"`
+	}{configStatus, chPrUpdated}
+	viewMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(status); err != nil {
+		log.Println("Ошибка при выводе состояния:", err)
+	}
+}
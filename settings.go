@@ -0,0 +1,829 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// reloadSettings считывает и проверяет настройки. Только если настройки без ошибок, они заменяют текущие.
+// Если в ini-файле не хватало настроек, сохраняет его
+func reloadSettings() error {
+	var set settings
+	file, changed, err := loadSettings(&set)
+	setConfigStatus(err)
+	if err != nil {
+		return err // текущие настройки остаются без изменений
+	}
+	cfstruct = set
+	cf = file
+	fetcher.configure(&cfstruct)
+	if !changed {
+		return nil // файл не изменялся. Форматирование и комментарии пользователя остаются как есть
+	}
+	return cf.SaveTo(nameIniFile) // сохранить файл с значениями по умолчанию
+}
+
+// loadSettings считывает данные с ini-файла и загружает в структуру set. При необходимости инициализирует данные значениями по умолчанию.
+// Сам ini-файл и текущие настройки не изменяются. changed сообщает, что в ini-файл нужно записать добавленные значения.
+// Ошибки в значениях возвращаются как *configError с указанием секции, ключа и строки
+func loadSettings(set *settings) (file *ini.File, changed bool, err error) {
+	var key *ini.Key
+	var value int
+
+	// открыть ini-файл
+	file, err = ini.Load(nameIniFile)
+	if err != nil {
+		if os.IsNotExist(err) { // файл с настройками не найден?
+			file = ini.Empty() // создать новый объект с настройками
+			changed = true
+		} else {
+			return nil, false, &configError{err: err}
+		}
+	}
+
+	// обработать секцию "general" с основными настройками
+	section, err := file.GetSection("general")
+	if err != nil {
+		section, err = file.NewSection("general") // секции нет в ini-файле? Тогда создать.
+		if err != nil {
+			return nil, false, err // если не удалось создать, то продолжать бессмысленно
+		}
+		changed = true
+		section.Comment = "Основные настройки"
+	}
+
+	// перечитывать настройки каждые .... сек
+	key, err = section.GetKey("updsetdelay")
+	if err != nil {
+		key, err = section.NewKey("updsetdelay", defUpdSetDelay)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Перечитывать настройки каждые ... сек. Целое число от 5 до 1000000, другое значение - ошибка в настройках."
+	}
+	value, err = intKey(section, key, 5, 1000000) // значение в пределах 5 - 1000000 секунд
+	if err != nil {
+		return nil, false, err
+	}
+	set.updsetdelay = value
+
+	// обновлять данные плейлиста каждые .... сек
+	key, err = section.GetKey("upddatadelay")
+	if err != nil {
+		key, err = section.NewKey("upddatadelay", defUpdDataDelay)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Обновлять данные плейлиста каждые ... сек. Целое число от 300 до 1000000, другое значение - ошибка в настройках."
+	}
+	value, err = intKey(section, key, 300, 1000000) // значение в пределах 300 - 1000000 секунд
+	if err != nil {
+		return nil, false, err
+	}
+	set.upddatadelay = value
+
+	// Имя файла плейлиста и путь до него.
+	key, err = section.GetKey("pathplaylist")
+	if err != nil {
+		key, err = section.NewKey("pathplaylist", defPathPlaylist)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Имя файла плейлиста и путь до него."
+	}
+	set.pathplaylist = key.String()
+
+	// Количество параллельных потоков для парсинга сайта
+	key, err = section.GetKey("workers")
+	if err != nil {
+		key, err = section.NewKey("workers", strconv.Itoa(defWorkers))
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Количество параллельных потоков для парсинга сайта. По умолчанию равен кол-ву ядер процессора. Целое число от 1 до 100, другое значение - ошибка в настройках."
+
+	}
+	value, err = intKey(section, key, 1, 100) // значение в пределах 1 - 100 отдельных потоков
+	if err != nil {
+		return nil, false, err
+	}
+	set.workers = value
+
+	// Поставщик программы передач по умолчанию
+	key, err = section.GetKey("provider")
+	if err != nil {
+		key, err = section.NewKey("provider", defProvider)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Поставщик программы передач по умолчанию. Допустимые значения: " + providerNames()
+	}
+	if _, err = getProvider(key.String()); err != nil {
+		return nil, false, newConfigError(section, key, err)
+	}
+	set.provider = key.String()
+
+	// Имя XMLTV-файла с программой передач
+	key, err = section.GetKey("xmltv")
+	if err != nil {
+		key, err = section.NewKey("xmltv", "")
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Имя XMLTV-файла с программой передач. Относительный путь отсчитывается от каталога плейлиста. Пустое значение - файл не создается."
+	}
+	set.xmltv = key.String()
+
+	// Сжимать XMLTV-файл
+	key, err = section.GetKey("xmltvgzip")
+	if err != nil {
+		key, err = section.NewKey("xmltvgzip", "false")
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Сжимать XMLTV-файл gzip (к имени файла добавляется .gz)."
+	}
+	set.xmltvgzip, err = key.Bool()
+	if err != nil {
+		return nil, false, newConfigError(section, key, fmt.Errorf("значение %q должно быть true или false", key.Value()))
+	}
+
+	// XMLTV-источник для поставщика xmltv
+	key, err = section.GetKey("xmltvsource")
+	if err != nil {
+		key, err = section.NewKey("xmltvsource", "")
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "XMLTV-источник программы передач для поставщика xmltv: путь к файлу или URL."
+	}
+	set.xmltvsource = key.String()
+
+	// Адрес http-сервера
+	key, err = section.GetKey("httpaddr")
+	if err != nil {
+		key, err = section.NewKey("httpaddr", defHTTPAddr)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Адрес http-сервера. Изменение вступает в силу после перезапуска программы."
+	}
+	set.httpaddr = key.String()
+
+	// Путь, по которому http-сервер отдает плейлист
+	key, err = section.GetKey("httppath")
+	if err != nil {
+		key, err = section.NewKey("httppath", defHTTPPath)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Путь, по которому http-сервер отдает плейлист. Пустое значение - плейлист не отдается."
+	}
+	set.httppath = key.String()
+	if set.httppath != "" && !strings.HasPrefix(set.httppath, "/") {
+		return nil, false, newConfigError(section, key, fmt.Errorf("путь должен начинаться с \"/\""))
+	}
+
+	// Заготовка плейлиста
+	key, err = section.GetKey("playlisttemplate")
+	if err != nil {
+		key, err = section.NewKey("playlisttemplate", "")
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Файл-заготовка, из которого создается плейлист, если файла pathplaylist нет (например, список каналов с прямыми трансляциями). Пустое значение - создается плейлист из строки #EXTM3U. Строки-якоря для каналов добавляются в обоих случаях."
+	}
+	set.pltemplate = key.String()
+
+	// Количество резервных копий плейлиста
+	key, err = section.GetKey("backups")
+	if err != nil {
+		key, err = section.NewKey("backups", defBackups)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Количество резервных копий плейлиста (файлы <плейлист>.1, <плейлист>.2, ...; .1 - самая новая). 0 - не хранить. Целое число от 0 до 100, другое значение - ошибка в настройках."
+	}
+	value, err = intKey(section, key, 0, 100) // значение в пределах 0 - 100 копий
+	if err != nil {
+		return nil, false, err
+	}
+	set.backups = value
+
+	// Шаблон ссылки на запись передачи
+	key, err = section.GetKey("streamurl")
+	if err != nil {
+		key, err = section.NewKey("streamurl", defStreamURL)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Шаблон ссылки на запись передачи (text/template). Доступны поля {{.ID}}, {{.Channel}}, {{.StartUnix}}, {{.StartUTC}}, {{.StartLocal}}, {{.StartISO}}, {{.EndUnix}}, {{.Duration}}, {{.DurationMin}}, {{.Start.Format \"15:04\"}} и др."
+	}
+	set.streamurl, err = parseTemplate("streamurl", key.String())
+	if err != nil {
+		return nil, false, newConfigError(section, key, err)
+	}
+
+	// Шаблон строки #EXTINF
+	key, err = section.GetKey("extinf")
+	if err != nil {
+		key, err = section.NewKey("extinf", defExtinf)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Шаблон атрибутов и названия записи передачи в строке #EXTINF (text/template). Кроме полей шаблона streamurl доступны {{.Name}}, {{.NameChannel}}, {{.Day}}, {{.DayOfWeek}}, {{.TimeBegin}}, {{.Date}}, {{.Href}}, {{.First}} (первая запись канала), {{.Description}}, {{.Genre}}, {{.AgeRating}}, {{.Year}}, {{.Country}}, {{.Poster}} (при details = true). Значения атрибутов пропускайте через функцию attr: group-title=\"{{attr .Group}}\"."
+	}
+	set.extinf, err = parseTemplate("extinf", key.String())
+	if err != nil {
+		return nil, false, newConfigError(section, key, err)
+	}
+
+	// Режим вывода архива
+	key, err = section.GetKey("archivemode")
+	if err != nil {
+		key, err = section.NewKey("archivemode", archiveModePrograms)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Режим вывода архива: programs - запись на каждую передачу между строками-якорями, catchup - атрибуты catchup, catchup-source, catchup-days у записи канала перед строкой-якорем, both - и то, и другое. Атрибуты, которые добавила программа, перечисляются в атрибуте updplaylist-attrs и удаляются, когда больше не нужны."
+	}
+	set.archivemode = key.String()
+	if set.archivemode != archiveModePrograms && set.archivemode != archiveModeCatchup && set.archivemode != archiveModeBoth {
+		return nil, false, newConfigError(section, key, fmt.Errorf("допустимые значения: %s, %s, %s", archiveModePrograms, archiveModeCatchup, archiveModeBoth))
+	}
+
+	// Место строк-якорей новых каналов
+	key, err = section.GetKey("anchorplace")
+	if err != nil {
+		key, err = section.NewKey("anchorplace", anchorPlaceEnd)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Куда ставить строки-якоря каналов, которых еще нет в плейлисте: end - в конец плейлиста, entry - сразу после записи канала с прямой трансляцией (поиск по tvg-id, tvg-name и похожему названию). Не найденные каналы ставятся в конец."
+	}
+	set.anchorplace = key.String()
+	if set.anchorplace != anchorPlaceEnd && set.anchorplace != anchorPlaceEntry {
+		return nil, false, newConfigError(section, key, fmt.Errorf("допустимые значения: %s, %s", anchorPlaceEnd, anchorPlaceEntry))
+	}
+
+	// Строки-якоря каналов, которых нет в настройках
+	key, err = section.GetKey("orphananchors")
+	if err != nil {
+		key, err = section.NewKey("orphananchors", orphanKeep)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Что делать со строками-якорями каналов, которых нет в секции channels: keep - оставить (блок остается пустым), remove - удалить, comment - закомментировать (#orphan #archive-begin-...). Закомментированные строки-якоря раскомментируются, если канал снова появится в настройках. Такие строки-якоря перечисляются в журнале при каждом обновлении."
+	}
+	set.orphans = key.String()
+	if set.orphans != orphanKeep && set.orphans != orphanRemove && set.orphans != orphanComment {
+		return nil, false, newConfigError(section, key, fmt.Errorf("допустимые значения: %s, %s, %s", orphanKeep, orphanRemove, orphanComment))
+	}
+
+	// Шаблон атрибута catchup-source
+	key, err = section.GetKey("catchupsource")
+	if err != nil {
+		key, err = section.NewKey("catchupsource", defCatchupSource)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Шаблон атрибута catchup-source записи канала (text/template, доступны {{.Channel}} и {{.NameChannel}}). Заполнители плеера ({catchup-id}, {utc}, ${start} и т.п.) передаются как есть."
+	}
+	set.catchupsrc, err = parseTemplate("catchupsource", key.String())
+	if err != nil {
+		return nil, false, newConfigError(section, key, err)
+	}
+	if set.archivemode != archiveModePrograms && set.xmltv == "" && strings.Contains(key.String(), "{catchup-id}") {
+		log.Printf("Предупреждение: archivemode = %s, но ключ xmltv не задан. {catchup-id} в catchupsource плеер берет из XMLTV-файла с программой передач. Задайте xmltv и укажите этот файл в плеере.\n", set.archivemode)
+	}
+
+	// Глубина архива
+	key, err = section.GetKey("archivedays")
+	if err != nil {
+		key, err = section.NewKey("archivedays", defArchiveDays)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Глубина архива в днях: в плейлист попадают передачи не старше заданного количества дней. 0 - все дни, которые отдает поставщик. Для отдельного канала задается ключом days секции [" + channelSectionPrefix + "<канал>]."
+	}
+	set.archivedays, err = intKey(section, key, 0, 365)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Только закончившиеся передачи
+	key, err = section.GetKey("airedonly")
+	if err != nil {
+		key, err = section.NewKey("airedonly", defAiredOnly)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "true - в плейлист попадают только передачи, которые уже закончились (окончание передачи - начало следующей), false (по умолчанию) - все передачи программы, как в прежних версиях. Чтобы выводить только закончившиеся передачи, задайте true."
+	}
+	set.airedonly, err = key.Bool()
+	if err != nil {
+		return nil, false, newConfigError(section, key, fmt.Errorf("значение %q должно быть true или false", key.Value()))
+	}
+
+	// Продолжительность последней передачи дня
+	key, err = section.GetKey("lastduration")
+	if err != nil {
+		key, err = section.NewKey("lastduration", defLastDuration)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Продолжительность в минутах последней передачи дня, если поставщик не сообщает время ее окончания, а программы следующего дня нет. 0 - продолжительность неизвестна (#EXTINF:-1, такая передача не считается закончившейся)."
+	}
+	set.lastduration, err = intKey(section, key, 0, 1440)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Подробности о передачах
+	key, err = section.GetKey("details")
+	if err != nil {
+		key, err = section.NewKey("details", defDetails)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "true - запрашивать со страниц передач описание, жанр, возрастное ограничение, год, страну и постер. Они доступны в шаблоне extinf и попадают в XMLTV-файл. Подробности запоминаются в хранилище store и повторно не запрашиваются, в том числе после перезапуска программы. Без хранилища они запоминаются только до перезапуска."
+	}
+	set.details, err = key.Bool()
+	if err != nil {
+		return nil, false, newConfigError(section, key, fmt.Errorf("значение %q должно быть true или false", key.Value()))
+	}
+
+	// Каталог кэша страниц сайта
+	key, err = section.GetKey("cachedir")
+	if err != nil {
+		key, err = section.NewKey("cachedir", defCacheDir)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Каталог, в котором сохраняются полученные страницы сайта с программой передач. Пустое значение (по умолчанию) - страницы не сохраняются. Чтобы включить кэш, укажите каталог, например cache."
+	}
+	set.cachedir = key.String()
+
+	// Время жизни страниц в кэше
+	key, err = section.GetKey("cachettl")
+	if err != nil {
+		key, err = section.NewKey("cachettl", defCacheTTL)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Сколько секунд страница в кэше используется без запроса к сайту. После этого сайт запрашивается с проверкой ETag/Last-Modified. Страницы прошедших дней не меняются и повторно не запрашиваются."
+	}
+	set.cachettl, err = intKey(section, key, 0, 7*24*3600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Хранилище программы передач
+	key, err = section.GetKey("store")
+	if err != nil {
+		key, err = section.NewKey("store", defStore)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Файл, в котором накапливается программа передач. Передачи остаются в плейлисте и после того, как сайт перестал их показывать. Пустое значение (по умолчанию) - хранилище не используется, плейлист формируется только из полученной программы передач. Чтобы включить хранилище, укажите имя файла, например updplaylist.db."
+	}
+	set.store = key.String()
+
+	// Срок хранения программы передач
+	key, err = section.GetKey("retention")
+	if err != nil {
+		key, err = section.NewKey("retention", defRetention)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Сколько дней хранить программу передач. 0 - без ограничения. Для отдельного канала задается ключом retention секции [" + channelSectionPrefix + "<канал>]."
+	}
+	set.retention, err = intKey(section, key, 0, 3650)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Время ожидания ответа сайта
+	key, err = section.GetKey("timeout")
+	if err != nil {
+		key, err = section.NewKey("timeout", defTimeout)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Сколько секунд ждать ответа сайта с программой передач, включая чтение страницы. 0 - без ограничения."
+	}
+	set.timeout, err = intKey(section, key, 0, 3600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Количество повторов неудачного запроса
+	key, err = section.GetKey("retries")
+	if err != nil {
+		key, err = section.NewKey("retries", defRetries)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Сколько раз повторять запрос при ошибке сети или ответе сайта 5xx/429. Пауза перед повтором растет: 1, 2, 4... секунды со случайным разбросом."
+	}
+	set.retries, err = intKey(section, key, 0, 10)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Ограничение частоты запросов
+	key, err = section.GetKey("rps")
+	if err != nil {
+		key, err = section.NewKey("rps", defRPS)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Не больше стольких запросов в секунду к одному сайту (можно дробное, например 0.5). 0 - без ограничения."
+	}
+	set.rps, err = key.Float64()
+	if err != nil || set.rps < 0 {
+		return nil, false, newConfigError(section, key, fmt.Errorf("значение %q должно быть неотрицательным числом", key.Value()))
+	}
+
+	// Заголовок User-Agent
+	key, err = section.GetKey("useragent")
+	if err != nil {
+		key, err = section.NewKey("useragent", defUserAgent)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Заголовок User-Agent запросов к сайтам. Пустое значение - заголовок Go по умолчанию."
+	}
+	set.useragent = key.String()
+
+	// Прокси-сервер
+	key, err = section.GetKey("proxy")
+	if err != nil {
+		key, err = section.NewKey("proxy", "")
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+		key.Comment = "Прокси-сервер для запросов к сайтам, например http://127.0.0.1:3128 или socks5://127.0.0.1:1080. Пустое значение - из переменных окружения HTTP_PROXY, HTTPS_PROXY."
+	}
+	set.proxy = nil
+	if key.String() != "" {
+		set.proxy, err = url.Parse(key.String())
+		if err != nil || set.proxy.Scheme == "" || set.proxy.Host == "" {
+			return nil, false, newConfigError(section, key, fmt.Errorf("неверный адрес прокси-сервера %q", key.String()))
+		}
+	}
+
+	// секция "каналы"
+	section, err = file.GetSection("channels")
+	if err != nil {
+		section, err = file.NewSection("channels") // секции нет в ini-файле? Создать секцию.
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	section.Comment = "Список каналов. Пример строки: -:rossija\n; Настройки отдельного канала задаются в секции [" + channelSectionPrefix + "<канал>]: " + strings.Join(channelKeys, ", ") +
+		".\n; Ключи секции [" + channelSectionPrefix + "<канал>] важнее строк канала в секциях providers, xmltvids, streamurl и extinf. Секция канала, которого нет в списке, - ошибка"
+
+	// секция содержит список каналов
+	ch := section.Keys() // получить массив списка каналов
+	set.channels = ch
+
+	set.chset = make(map[string]*channelSettings)
+	for _, key := range ch {
+		set.chset[key.Value()] = &channelSettings{provider: set.provider, streamurl: set.streamurl, extinf: set.extinf, days: set.archivedays, retention: set.retention, enabled: true}
+	}
+
+	// секция "поставщики" задает поставщика программы передач для отдельных каналов
+	section, err = file.GetSection("providers")
+	if err != nil {
+		section, err = file.NewSection("providers") // секции нет в ini-файле? Создать секцию.
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	section.Comment = "Поставщики программы передач для отдельных каналов. Пример строки: rossija = cnru. Ключ provider секции [" + channelSectionPrefix + "<канал>] важнее"
+
+	for _, key := range section.Keys() {
+		if _, err = getProvider(key.Value()); err != nil {
+			return nil, false, newConfigError(section, key, err)
+		}
+		if chs, ok := set.chset[key.Name()]; ok {
+			chs.provider = key.Value()
+		}
+	}
+
+	// секция с идентификаторами каналов в XMLTV-источнике
+	section, err = file.GetSection("xmltvids")
+	if err != nil {
+		section, err = file.NewSection("xmltvids") // секции нет в ini-файле? Создать секцию.
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	section.Comment = "Идентификаторы каналов в XMLTV-источнике. Пример строки: rossija = Russia1.ru. Ключ xmltvid секции [" + channelSectionPrefix + "<канал>] важнее"
+
+	for _, key := range section.Keys() {
+		if chs, ok := set.chset[key.Name()]; ok {
+			chs.xmltvid = key.Value()
+		}
+	}
+
+	// секция с шаблонами ссылок на запись передачи для отдельных каналов
+	section, err = file.GetSection("streamurl")
+	if err != nil {
+		section, err = file.NewSection("streamurl") // секции нет в ini-файле? Создать секцию.
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	section.Comment = "Шаблоны ссылок на запись передачи для отдельных каналов. Заменяют шаблон streamurl секции general. Пример строки: rossija = http://example.com/archive/{{.ID}}.m3u8. Ключ streamurl секции [" + channelSectionPrefix + "<канал>] важнее"
+
+	for _, key := range section.Keys() {
+		tmpl, err := parseTemplate("streamurl", key.Value())
+		if err != nil {
+			return nil, false, newConfigError(section, key, err)
+		}
+		if chs, ok := set.chset[key.Name()]; ok {
+			chs.streamurl = tmpl
+		}
+	}
+
+	// секция с шаблонами строки #EXTINF для отдельных каналов
+	section, err = file.GetSection("extinf")
+	if err != nil {
+		section, err = file.NewSection("extinf") // секции нет в ini-файле? Создать секцию.
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	section.Comment = "Шаблоны строки #EXTINF для отдельных каналов. Заменяют шаблон extinf секции general. Пример строки: rossija = tvg-id=\"{{.Channel}}\" group-title=\"Архив\",{{.TimeBegin}} {{.Name}}. Ключ extinf секции [" + channelSectionPrefix + "<канал>] важнее"
+
+	for _, key := range section.Keys() {
+		tmpl, err := parseTemplate("extinf", key.Value())
+		if err != nil {
+			return nil, false, newConfigError(section, key, err)
+		}
+		if chs, ok := set.chset[key.Name()]; ok {
+			chs.extinf = tmpl
+		}
+	}
+
+	// секции [channel.<канал>] с настройками отдельных каналов. Загружаются последними,
+	// поэтому их ключи заменяют строки канала в секциях providers, xmltvids, streamurl и extinf
+	for _, section := range file.Sections() {
+		if !strings.HasPrefix(section.Name(), channelSectionPrefix) {
+			continue
+		}
+		chs, ok := set.chset[strings.TrimPrefix(section.Name(), channelSectionPrefix)]
+		if !ok { // скорее всего, опечатка в названии канала. Молча пропущенные настройки было бы трудно заметить
+			return nil, false, newSectionError(section, fmt.Errorf("канала нет в секции channels"))
+		}
+		if err = loadChannelSection(section, chs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// отключенные каналы не обрабатываются, как если бы их не было в секции channels
+	var enabled []*ini.Key
+	for _, key := range set.channels {
+		if set.chset[key.Value()].enabled {
+			enabled = append(enabled, key)
+		}
+	}
+	set.channels = enabled
+
+	return file, changed, nil
+}
+
+// updSettings обновляет настройки из ini-файла сразу после его изменения.
+// Дополнительно, на случай если слежение за файлом недоступно, настройки перечитываются с заданной периодичностью
+func updSettings(ctx context.Context) {
+	changes := watchSettings(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		case <-time.After(time.Duration(cfstruct.updsetdelay) * time.Second):
+		}
+
+		mutex.Lock()
+		old := cfstruct
+		err := reloadSettings()
+		var req rebuildRequest
+		var rebuildNeeded bool
+		if err == nil {
+			publishSettings()
+			req, rebuildNeeded = diffSettings(&old, &cfstruct)
+		}
+		mutex.Unlock()
+		if err != nil {
+			log.Println("Ошибка в файле с настройками. Работа продолжается с прежними настройками:", err)
+			continue
+		}
+		log.Println("Настройки обновлены")
+		if rebuildNeeded {
+			requestRebuild(req)
+		}
+	}
+}
+
+const channelSectionPrefix = "channel." // префикс секций с настройками отдельных каналов
+
+// ключи секции с настройками отдельного канала
+var channelKeys = []string{"name", "group", "days", "retention", "enabled", "provider", "xmltvid", "streamurl", "extinf"}
+
+// loadChannelSection загружает и проверяет настройки отдельного канала
+func loadChannelSection(section *ini.Section, chs *channelSettings) error {
+	var err error
+	for _, key := range section.Keys() {
+		switch key.Name() {
+		case "name": // название канала
+			chs.name = key.String()
+		case "group": // группа записей архива
+			chs.group = key.String()
+		case "days": // глубина архива в днях
+			if chs.days, err = intKey(section, key, 0, 365); err != nil {
+				return err
+			}
+		case "retention": // срок хранения программы передач в днях
+			if chs.retention, err = intKey(section, key, 0, 3650); err != nil {
+				return err
+			}
+		case "enabled": // канал включен
+			if chs.enabled, err = key.Bool(); err != nil {
+				return newConfigError(section, key, fmt.Errorf("значение %q должно быть true или false", key.Value()))
+			}
+		case "provider": // поставщик программы передач
+			if _, err = getProvider(key.String()); err != nil {
+				return newConfigError(section, key, err)
+			}
+			chs.provider = key.String()
+		case "xmltvid": // идентификатор канала в XMLTV-источнике
+			chs.xmltvid = key.String()
+		case "streamurl": // шаблон ссылки на запись передачи
+			if chs.streamurl, err = parseTemplate("streamurl", key.String()); err != nil {
+				return newConfigError(section, key, err)
+			}
+		case "extinf": // шаблон строки #EXTINF
+			if chs.extinf, err = parseTemplate("extinf", key.String()); err != nil {
+				return newConfigError(section, key, err)
+			}
+		default:
+			return newConfigError(section, key, fmt.Errorf("неизвестный ключ. Допустимые ключи: %s", strings.Join(channelKeys, ", ")))
+		}
+	}
+	return nil
+}
+
+// configError ошибка в файле с настройками с указанием места
+type configError struct {
+	section string // секция. Пустая, если ошибка в разборе файла
+	key     string // ключ. Пустой, если ошибка относится ко всей секции
+	line    int    // номер строки в файле. 0, если строку определить не удалось
+	err     error
+}
+
+// newConfigError создает ошибку в значении ключа и определяет строку, в которой он задан
+func newConfigError(section *ini.Section, key *ini.Key, err error) *configError {
+	e := &configError{section: section.Name(), key: key.Name(), err: err}
+	e.line = configLine(e.section, e.key)
+	return e
+}
+
+// newSectionError создает ошибку, относящуюся ко всей секции
+func newSectionError(section *ini.Section, err error) *configError {
+	e := &configError{section: section.Name(), err: err}
+	e.line = configLine(e.section, e.key)
+	return e
+}
+
+func (e *configError) Error() string {
+	var where []string
+	if e.line > 0 {
+		where = append(where, fmt.Sprintf("%s:%d", nameIniFile, e.line))
+	} else {
+		where = append(where, nameIniFile)
+	}
+	if e.section != "" {
+		where = append(where, "секция ["+e.section+"]")
+	}
+	if e.key != "" {
+		where = append(where, "ключ "+e.key)
+	}
+	return strings.Join(where, ", ") + ": " + e.err.Error()
+}
+
+// configLine ищет в ini-файле номер строки, в которой в секции задан ключ. 0, если не найдена
+func configLine(section, key string) int {
+	lines, err := readLines(nameIniFile)
+	if err != nil {
+		return 0
+	}
+	current := ini.DEFAULT_SECTION
+	for i, str := range lines {
+		str = strings.TrimSpace(str)
+		if strings.HasPrefix(str, "[") && strings.HasSuffix(str, "]") {
+			current = strings.TrimSpace(str[1 : len(str)-1])
+			if current == section && key == "" { // ошибка относится ко всей секции
+				return i + 1
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		name := str
+		if n := strings.IndexAny(str, "=:"); n >= 0 {
+			name = strings.TrimSpace(str[:n])
+		}
+		if name == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// intKey проверяет, что значение ключа - целое число в заданных пределах
+func intKey(section *ini.Section, key *ini.Key, min, max int) (int, error) {
+	value, err := key.Int()
+	if err != nil || value < min || value > max {
+		return 0, newConfigError(section, key, fmt.Errorf("значение %q должно быть целым числом от %d до %d", key.Value(), min, max))
+	}
+	return value, nil
+}
+
+// состояние последнего перечитывания настроек
+type configState struct {
+	OK       bool      `json:"ok"`                // настройки загружены без ошибок
+	Time     time.Time `json:"time"`              // время последнего перечитывания
+	LastGood time.Time `json:"last_good"`         // время, когда настройки последний раз загрузились без ошибок
+	Error    string    `json:"error,omitempty"`   // текст ошибки
+	Section  string    `json:"section,omitempty"` // секция с ошибкой
+	Key      string    `json:"key,omitempty"`     // ключ с ошибкой
+	Line     int       `json:"line,omitempty"`    // строка с ошибкой
+}
+
+var configStatus configState // защищается viewMutex
+
+// setConfigStatus запоминает результат перечитывания настроек для страницы состояния
+func setConfigStatus(err error) {
+	viewMutex.Lock()
+	defer viewMutex.Unlock()
+
+	configStatus.Time = time.Now()
+	configStatus.OK = err == nil
+	configStatus.Error, configStatus.Section, configStatus.Key, configStatus.Line = "", "", "", 0
+	if err == nil {
+		configStatus.LastGood = configStatus.Time
+		return
+	}
+	configStatus.Error = err.Error()
+	if e, ok := err.(*configError); ok {
+		configStatus.Section, configStatus.Key, configStatus.Line = e.section, e.key, e.line
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const storeTimeFormat = "20060102150405" // ключ записи в хранилище - время начала передачи по UTC
+
+var store *bolt.DB   // хранилище программы передач. Используется только в updatePlaylist при захваченном mutex (горутины пула только читают)
+var storePath string // путь к открытому хранилищу
+
+// запись передачи в хранилище
+type storedProgr struct {
+	NameChannel    string    `json:"name_channel"`
+	Datepr         time.Time `json:"datepr"`
+	Timepr         time.Time `json:"timepr"`
+	TimeBeginProgr string    `json:"time_begin"`
+	NameProgr      string    `json:"name"`
+	HrefProgr      string    `json:"href,omitempty"`
+	IDProgr        string    `json:"id"`
+	Day            string    `json:"day"`
+	DayOfWeek      string    `json:"day_of_week"`
+	DataProgr      time.Time `json:"date"`
+	Endpr          time.Time `json:"end,omitempty"`
+	Group          string    `json:"group,omitempty"`
+	Description    string    `json:"description,omitempty"`
+	Genre          string    `json:"genre,omitempty"`
+	AgeRating      string    `json:"age_rating,omitempty"`
+	Year           string    `json:"year,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	Poster         string    `json:"poster,omitempty"`
+}
+
+// openStore открывает хранилище. Если открыто хранилище с другим путем, оно закрывается
+func openStore(path string) error {
+	if store != nil && storePath == path {
+		return nil
+	}
+	closeStore()
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second}) // файл занят другим экземпляром программы? Не ждать вечно
+	if err != nil {
+		return fmt.Errorf("не удалось открыть хранилище %s: %v", path, err)
+	}
+	store = db
+	storePath = path
+	return nil
+}
+
+// closeStore закрывает хранилище
+func closeStore() {
+	if store != nil {
+		store.Close()
+		store = nil
+		storePath = ""
+	}
+}
+
+// syncStore сохраняет в хранилище только что полученную программу передач и возвращает всю накопленную.
+// Дни, полученные заново, заменяются целиком. Передачи старше срока хранения канала удаляются
+func syncStore(fetched map[string][]progr, set *settings, now time.Time) (map[string][]progr, error) {
+	if err := openStore(set.store); err != nil {
+		return nil, err
+	}
+
+	err := store.Update(func(tx *bolt.Tx) error {
+		for ch, list := range fetched {
+			b, err := tx.CreateBucketIfNotExists([]byte(ch))
+			if err != nil {
+				return err
+			}
+			days := make(map[string]bool) // дни, программа которых получена заново
+			for _, p := range list {
+				days[p.dataProgr.Format("2006-01-02")] = true
+			}
+			if err := deleteProgr(b, func(s storedProgr) bool { return days[s.DataProgr.Format("2006-01-02")] }); err != nil {
+				return err
+			}
+			for _, p := range list {
+				value, err := json.Marshal(toStored(p))
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(p.timepr.UTC().Format(storeTimeFormat)), value); err != nil {
+					return err
+				}
+			}
+		}
+
+		// срок хранения
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			days := set.retention
+			if chs, ok := set.chset[string(name)]; ok {
+				days = chs.retention
+			}
+			if days == 0 {
+				return nil // хранить без ограничения
+			}
+			first := dayStart(now).AddDate(0, 0, -days)
+			return deleteProgr(b, func(s storedProgr) bool { return s.DataProgr.Before(first) })
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при записи в хранилище: %v", err)
+	}
+
+	data := make(map[string][]progr)
+	err = store.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			ch := string(name)
+			return b.ForEach(func(k, v []byte) error {
+				var s storedProgr
+				if err := json.Unmarshal(v, &s); err != nil {
+					return fmt.Errorf("канал %s, запись %s: %v", ch, k, err)
+				}
+				p := fromStored(ch, s)
+				if chs, ok := set.chset[ch]; ok { // название и группа канала из текущих настроек
+					p.group = chs.group
+					if chs.name != "" {
+						p.nameChannel = chs.name
+					}
+				}
+				data[ch] = append(data[ch], p)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при чтении хранилища: %v", err)
+	}
+	return data, nil
+}
+
+// storedDetails ищет в хранилище подробности о передаче, полученные при прошлых обновлениях или прошлых запусках программы.
+// Возвращает false, если хранилище не открыто или подробностей нет
+func storedDetails(p progr) (progrDetails, bool) {
+	if store == nil {
+		return progrDetails{}, false
+	}
+	var details progrDetails
+	store.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(p.channel))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(p.timepr.UTC().Format(storeTimeFormat)))
+		var s storedProgr
+		if v == nil || json.Unmarshal(v, &s) != nil || s.IDProgr != p.idProgr { // на это время записана другая передача
+			return nil
+		}
+		details = fromStored(p.channel, s).details
+		return nil
+	})
+	return details, !details.empty()
+}
+
+// deleteProgr удаляет из корзины канала передачи, для которых del возвращает true
+func deleteProgr(b *bolt.Bucket, del func(s storedProgr) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var s storedProgr
+		if err := json.Unmarshal(v, &s); err != nil || del(s) { // испорченную запись тоже удалить
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys { // удалять записи внутри ForEach нельзя
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toStored переводит передачу в запись хранилища
+func toStored(p progr) storedProgr {
+	return storedProgr{
+		NameChannel:    p.nameChannel,
+		Datepr:         p.datepr,
+		Timepr:         p.timepr,
+		TimeBeginProgr: p.timeBeginProgr,
+		NameProgr:      p.nameProgr,
+		HrefProgr:      p.hrefProgr,
+		IDProgr:        p.idProgr,
+		Day:            p.day,
+		DayOfWeek:      p.dayOfWeek,
+		DataProgr:      p.dataProgr,
+		Endpr:          p.endpr,
+		Group:          p.group,
+		Description:    p.details.description,
+		Genre:          p.details.genre,
+		AgeRating:      p.details.ageRating,
+		Year:           p.details.year,
+		Country:        p.details.country,
+		Poster:         p.details.poster,
+	}
+}
+
+// fromStored переводит запись хранилища в передачу
+func fromStored(channel string, s storedProgr) progr {
+	return progr{
+		channel:        channel,
+		nameChannel:    s.NameChannel,
+		datepr:         s.Datepr,
+		timepr:         s.Timepr,
+		timeBeginProgr: s.TimeBeginProgr,
+		nameProgr:      s.NameProgr,
+		hrefProgr:      s.HrefProgr,
+		idProgr:        s.IDProgr,
+		day:            s.Day,
+		dayOfWeek:      s.DayOfWeek,
+		dataProgr:      s.DataProgr,
+		endpr:          s.Endpr,
+		group:          s.Group,
+		details: progrDetails{
+			description: s.Description,
+			genre:       s.Genre,
+			ageRating:   s.AgeRating,
+			year:        s.Year,
+			country:     s.Country,
+			poster:      s.Poster,
+		},
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"github.com/Dremalka/updplaylist/internal/m3u"
+)
+
+// ссылка на запись передачи по умолчанию
+const defStreamURL = "http://hls.peers.tv/playlist/program/{{.ID}}.m3u8"
+
+// атрибуты и название записи передачи в строке #EXTINF по умолчанию
+const defExtinf = `crop=1920x1080+0+0 aspect-ratio=16:9{{if .First}} group-title="{{attr .Group}}"{{end}},{{.Day}} {{.DayOfWeek}} {{.TimeBegin}} "{{.Name}}"`
+
+var defStreamTmpl = template.Must(parseTemplate("streamurl", defStreamURL))
+var defExtinfTmpl = template.Must(parseTemplate("extinf", defExtinf))
+
+// progrData данные передачи, доступные в шаблонах ini-файла.
+// Время начала и окончания передачи можно вывести в произвольном формате: {{.Start.Format "2006-01-02 15:04"}}
+type progrData struct {
+	Channel     string    // название канала в секции channels
+	NameChannel string    // название канала на сайте или из настроек канала
+	Group       string    // группа записей архива: из настроек канала или "<название канала> (архив)"
+	ID          string    // идентификатор передачи
+	Name        string    // название передачи
+	Href        string    // ссылка на страницу передачи
+	Day         string    // день программы передач
+	DayOfWeek   string    // день недели
+	Date        time.Time // дата дня программы передач
+	TimeBegin   string    // время начала передачи в виде строки
+	Start       time.Time // время начала передачи
+	StartUnix   int64     // время начала передачи в секундах от 01.01.1970 (unix time)
+	StartUTC    string    // время начала передачи по UTC в формате 20060102150405
+	StartLocal  string    // местное время начала передачи в формате 20060102150405
+	StartISO    string    // время начала передачи в формате RFC 3339
+	End         time.Time // время окончания передачи. Нулевое, если неизвестно
+	EndUnix     int64     // время окончания передачи (unix time). 0, если неизвестно
+	Duration    int       // продолжительность передачи в секундах. 0, если неизвестна
+	DurationMin int       // продолжительность передачи в минутах. 0, если неизвестна
+	First       bool      // первая передача в блоке канала
+	Description string    // описание передачи. Заполняется, если задано details = true или описание есть в XMLTV-источнике
+	Genre       string    // жанр
+	AgeRating   string    // возрастное ограничение, например 16+
+	Year        string    // год выпуска
+	Country     string    // страна
+	Poster      string    // ссылка на постер
+}
+
+// newProgrData готовит данные передачи для шаблонов
+func newProgrData(p progr) progrData {
+	d := progrData{
+		Channel:     p.channel,
+		NameChannel: p.nameChannel,
+		Group:       p.group,
+		ID:          p.idProgr,
+		Name:        p.nameProgr,
+		Href:        p.hrefProgr,
+		Day:         p.day,
+		DayOfWeek:   p.dayOfWeek,
+		Date:        p.dataProgr,
+		TimeBegin:   p.timeBeginProgr,
+		Start:       p.timepr,
+		StartUnix:   p.timepr.Unix(),
+		StartUTC:    p.timepr.UTC().Format("20060102150405"),
+		StartLocal:  p.timepr.Local().Format("20060102150405"),
+		StartISO:    p.timepr.Format(time.RFC3339),
+		End:         p.endpr,
+		Description: p.details.description,
+		Genre:       p.details.genre,
+		AgeRating:   p.details.ageRating,
+		Year:        p.details.year,
+		Country:     p.details.country,
+		Poster:      p.details.poster,
+	}
+	if d.Group == "" {
+		d.Group = p.nameChannel + " (архив)"
+	}
+	if !p.endpr.IsZero() {
+		d.EndUnix = p.endpr.Unix()
+		d.Duration = int(p.duration() / time.Second)
+		d.DurationMin = int(p.duration() / time.Minute)
+	}
+	return d
+}
+
+// функции шаблонов. attr готовит значение атрибута #EXTINF: group-title="{{attr .Group}}"
+var templateFuncs = template.FuncMap{
+	"attr": m3u.EscapeValue,
+}
+
+// parseTemplate разбирает шаблон из ini-файла и проверяет, что он заполняется данными передачи
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err = tmpl.Execute(ioutil.Discard, progrData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// execTemplate заполняет шаблон данными и возвращает результат
+func execTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const watchDebounce = 300 * time.Millisecond // редактор может записать файл в несколько приемов. Ждать, пока изменения закончатся
+
+// watchSettings следит за ini-файлом и сообщает в канал о его изменении.
+// Следить приходится за каталогом: многие редакторы не изменяют файл, а заменяют его новым.
+// Если слежение недоступно, возвращает nil: из такого канала ничего не приходит, остается периодическое перечитывание
+func watchSettings(ctx context.Context) <-chan struct{} {
+	path, err := filepath.Abs(nameIniFile)
+	if err != nil {
+		log.Println("Слежение за файлом с настройками недоступно:", err)
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("Слежение за файлом с настройками недоступно:", err)
+		return nil
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		log.Println("Слежение за файлом с настройками недоступно:", err)
+		return nil
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				debounce = time.After(watchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Ошибка слежения за файлом с настройками:", err)
+			case <-debounce:
+				debounce = nil
+				select {
+				case changes <- struct{}{}:
+				default: // перечитывание уже запрошено
+				}
+			}
+		}
+	}()
+	return changes
+}
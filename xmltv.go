@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const xmltvTimeFormat = "20060102150405 -0700" // формат времени в XMLTV
+
+// структура XMLTV-файла
+type xmltvTv struct {
+	XMLName       xml.Name         `xml:"tv"`
+	GeneratorName string           `xml:"generator-info-name,attr,omitempty"`
+	Channels      []xmltvChannel   `xml:"channel"`
+	Programmes    []xmltvProgramme `xml:"programme"`
+}
+
+// канал XMLTV
+type xmltvChannel struct {
+	ID           string      `xml:"id,attr"`
+	DisplayNames []xmltvText `xml:"display-name"`
+}
+
+// передача XMLTV
+type xmltvProgramme struct {
+	Start      string       `xml:"start,attr"`
+	Stop       string       `xml:"stop,attr,omitempty"`
+	Channel    string       `xml:"channel,attr"`
+	Titles     []xmltvText  `xml:"title"`
+	Descs      []xmltvText  `xml:"desc"`
+	Date       string       `xml:"date,omitempty"`
+	Categories []xmltvText  `xml:"category"`
+	Icon       *xmltvIcon   `xml:"icon"`
+	URL        string       `xml:"url,omitempty"`
+	Countries  []xmltvText  `xml:"country"`
+	Rating     *xmltvRating `xml:"rating"`
+	CatchupID  string       `xml:"catchup-id,attr,omitempty"`
+}
+
+// изображение передачи XMLTV
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+// возрастное ограничение передачи XMLTV
+type xmltvRating struct {
+	Value string `xml:"value"`
+}
+
+// текстовый элемент XMLTV с необязательным указанием языка
+type xmltvText struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// xmltvPath возвращает путь к XMLTV-файлу. Относительный путь отсчитывается от каталога плейлиста
+func xmltvPath(name, pathplaylist string, gz bool) string {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(pathplaylist), path)
+	}
+	if gz && !strings.HasSuffix(path, ".gz") {
+		path += ".gz"
+	}
+	return path
+}
+
+// buildXMLTV собирает из данных программы передач структуру XMLTV
+func buildXMLTV(data map[string][]progr) *xmltvTv {
+	tv := &xmltvTv{GeneratorName: "updplaylist"}
+
+	var channels []string
+	for ch := range data {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+
+	for _, ch := range channels {
+		list := data[ch]
+		if len(list) == 0 {
+			continue
+		}
+		tv.Channels = append(tv.Channels, xmltvChannel{
+			ID:           ch,
+			DisplayNames: []xmltvText{{Lang: "ru", Value: list[0].nameChannel}},
+		})
+
+		// в XMLTV передачи канала перечисляются по времени начала
+		sorted := make([]progr, len(list))
+		copy(sorted, list)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].timepr.Before(sorted[j].timepr)
+		})
+
+		for _, vol := range sorted {
+			prg := xmltvProgramme{
+				Start:     vol.timepr.Format(xmltvTimeFormat),
+				Channel:   ch,
+				Titles:    []xmltvText{{Lang: "ru", Value: vol.nameProgr}},
+				URL:       vol.hrefProgr,
+				CatchupID: vol.idProgr, // по нему плеер подставляет передачу в catchup-source
+			}
+			if !vol.endpr.IsZero() {
+				prg.Stop = vol.endpr.Format(xmltvTimeFormat)
+			}
+			setXMLTVDetails(&prg, vol.details)
+			tv.Programmes = append(tv.Programmes, prg)
+		}
+	}
+	return tv
+}
+
+// setXMLTVDetails добавляет в передачу XMLTV подробности о ней
+func setXMLTVDetails(prg *xmltvProgramme, d progrDetails) {
+	if d.description != "" {
+		prg.Descs = []xmltvText{{Lang: "ru", Value: d.description}}
+	}
+	prg.Date = d.year
+	if d.genre != "" {
+		prg.Categories = []xmltvText{{Lang: "ru", Value: d.genre}}
+	}
+	if d.poster != "" {
+		prg.Icon = &xmltvIcon{Src: d.poster}
+	}
+	if d.country != "" {
+		prg.Countries = []xmltvText{{Lang: "ru", Value: d.country}}
+	}
+	if d.ageRating != "" {
+		prg.Rating = &xmltvRating{Value: d.ageRating}
+	}
+}
+
+// xmltvDetails возвращает подробности о передаче из XMLTV-источника
+func xmltvDetails(prg xmltvProgramme) progrDetails {
+	var d progrDetails
+	if len(prg.Descs) > 0 {
+		d.description = prg.Descs[0].Value
+	}
+	if len(prg.Categories) > 0 {
+		d.genre = prg.Categories[0].Value
+	}
+	if prg.Rating != nil {
+		d.ageRating = prg.Rating.Value
+	}
+	d.year = prg.Date
+	if len(prg.Countries) > 0 {
+		d.country = prg.Countries[0].Value
+	}
+	if prg.Icon != nil {
+		d.poster = prg.Icon.Src
+	}
+	return d
+}
+
+// writeXMLTV записывает программу передач в XMLTV-файл. При необходимости сжимает его gzip
+func writeXMLTV(data map[string][]progr, path string, gz bool) error {
+	return writeFileAtomic(path, 0, func(w io.Writer) error {
+		return encodeXMLTV(w, data, gz)
+	})
+}
+
+// encodeXMLTV выводит программу передач в формате XMLTV
+func encodeXMLTV(w io.Writer, data map[string][]progr, gz bool) error {
+	var err error
+	out := w
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(w)
+		out = zw
+	}
+
+	if _, err = io.WriteString(out, xml.Header+`<!DOCTYPE tv SYSTEM "xmltv.dtd">`+"\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err = enc.Encode(buildXMLTV(data)); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(out, "\n"); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
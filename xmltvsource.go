@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+const xmltvSourceTTL = 5 * time.Minute // сколько времени использовать однажды загруженный XMLTV-источник
+
+// сокращенные названия дней недели
+var shortWeekdays = [...]string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+// xmltvProvider получает программу передач из XMLTV-файла или по URL.
+// Источник задается ключом xmltvsource секции general ini-файла, соответствие каналов - секцией xmltvids
+// или ключом xmltvid секции channel.<канал>.
+type xmltvProvider struct{}
+
+// загруженный XMLTV-источник. Используется всеми горутинами до истечения xmltvSourceTTL
+var xmltvCache struct {
+	sync.Mutex
+	source string
+	loaded time.Time
+	tv     *xmltvTv
+}
+
+// listDays возвращает по одному дню на каждую дату, за которую в источнике есть передачи канала
+func (xmltvProvider) listDays(ctx context.Context, channel string) ([]listDay, error) {
+	id, tv, err := xmltvChannelData(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var nameChannel string
+	for _, ch := range tv.Channels {
+		if ch.ID == id && len(ch.DisplayNames) > 0 {
+			nameChannel = ch.DisplayNames[0].Value
+			break
+		}
+	}
+
+	var list []listDay
+	seen := make(map[string]bool)
+	for _, prg := range tv.Programmes {
+		if prg.Channel != id {
+			continue
+		}
+		start, err := parseXMLTVTime(prg.Start)
+		if err != nil {
+			continue
+		}
+		date := start.Format("2006-01-02")
+		if seen[date] {
+			continue
+		}
+		seen[date] = true
+
+		thisDay := listDay{}
+		thisDay.channel = channel
+		thisDay.nameChannel = nameChannel
+		thisDay.url = date
+		thisDay.dataProgr, _ = time.Parse("2006-01-02", date)
+		thisDay.day = start.Format("02.01")
+		thisDay.dayOfWeek = shortWeekdays[start.Weekday()]
+		list = append(list, thisDay)
+	}
+	if list == nil {
+		return nil, fmt.Errorf("в XMLTV-источнике нет передач канала %q", id)
+	}
+	return list, nil
+}
+
+// listProgr отбирает из источника передачи канала, начинающиеся в заданный день
+func (xmltvProvider) listProgr(ctx context.Context, day listDay) ([]progr, error) {
+	id, tv, err := xmltvChannelData(ctx, day.channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var listProgr []progr
+	for _, prg := range tv.Programmes {
+		if prg.Channel != id {
+			continue
+		}
+		start, err := parseXMLTVTime(prg.Start)
+		if err != nil || start.Format("2006-01-02") != day.url {
+			continue
+		}
+		yearPr, monthPr, dayPr := start.Date()
+
+		strProgr := progr{}
+		strProgr.datepr = time.Date(yearPr, monthPr, dayPr, 0, 0, 0, 0, start.Location())
+		strProgr.timepr = start
+		strProgr.timeBeginProgr = start.Format("15:04")
+		if prg.Stop != "" {
+			if stop, err := parseXMLTVTime(prg.Stop); err == nil {
+				strProgr.endpr = stop // окончание передачи задано источником
+			}
+		}
+		if len(prg.Titles) > 0 {
+			strProgr.nameProgr = prg.Titles[0].Value
+		}
+		strProgr.hrefProgr = prg.URL
+		strProgr.details = xmltvDetails(prg) // подробности о передаче, если они есть в источнике
+		strProgr.idProgr = prg.CatchupID
+		if strProgr.idProgr == "" {
+			strProgr.idProgr = start.UTC().Format("20060102150405")
+		}
+		listProgr = append(listProgr, strProgr)
+	}
+	return listProgr, nil
+}
+
+// xmltvChannelData возвращает идентификатор канала в XMLTV-источнике и сам загруженный источник
+func xmltvChannelData(ctx context.Context, channel string) (string, *xmltvTv, error) {
+	id := channel
+	if chs, ok := cfstruct.chset[channel]; ok && chs.xmltvid != "" {
+		id = chs.xmltvid
+	}
+	tv, err := loadXMLTVSource(ctx, cfstruct.xmltvsource)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, tv, nil
+}
+
+// loadXMLTVSource загружает и разбирает XMLTV-источник. Повторные вызовы в течение xmltvSourceTTL берут данные из памяти
+func loadXMLTVSource(ctx context.Context, source string) (*xmltvTv, error) {
+	if source == "" {
+		return nil, fmt.Errorf("не задан XMLTV-источник (ключ xmltvsource секции general)")
+	}
+
+	xmltvCache.Lock()
+	defer xmltvCache.Unlock()
+	if xmltvCache.tv != nil && xmltvCache.source == source && time.Since(xmltvCache.loaded) < xmltvSourceTTL {
+		return xmltvCache.tv, nil
+	}
+
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, body, err := fetcher.get(ctx, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("XMLTV-источник %s вернул статус %s", source, resp.Status)
+		}
+		r = ioutil.NopCloser(bytes.NewReader(body))
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	defer r.Close()
+
+	// источник может быть сжат gzip
+	br := bufio.NewReader(r)
+	var in io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	tv := &xmltvTv{}
+	dec := xml.NewDecoder(in)
+	dec.Strict = false
+	dec.CharsetReader = charset.NewReaderLabel // многие XMLTV-файлы в кодировке windows-1251
+	if err := dec.Decode(tv); err != nil {
+		return nil, fmt.Errorf("ошибка разбора XMLTV-источника %s: %v", source, err)
+	}
+
+	xmltvCache.source = source
+	xmltvCache.loaded = time.Now()
+	xmltvCache.tv = tv
+	return tv, nil
+}
+
+// parseXMLTVTime разбирает время в формате XMLTV. Часовой пояс может отсутствовать
+func parseXMLTVTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(xmltvTimeFormat, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("20060102150405", s, time.Local)
+}